@@ -1,24 +1,87 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"os"
 	"strconv"
+	"strings"
 )
 
-// Arguments
+// Arguments: host:port baseDir blockSize, or just baseDir with the rest
+// coming from its .surfconfig, -profile and the flags
 const ARG_COUNT int = 3
+const SHORT_ARG_COUNT int = 1
+
+// Block size of base directories that none of the settings give one
+const DEFAULT_BLOCK_SIZE int = 4096
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d -log-level level -u user -full-rescan -exclude pattern -select path -dry-run -json -trace exporter -tls-ca file -tls-cert file -tls-key file -profile name -m host:port -b blockSize -rechunk -upload-limit rate -download-limit rate [host:port] baseDir [blockSize]"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
 
+const LOGLEVEL_NAME = "log-level"
+const LOGLEVEL_USAGE = "Lowest level to log: debug, info, warn, error or off (-d means debug)"
+
+const USER_NAME = "u"
+const USER_USAGE = "User to sync as (access to shared folders is checked against it)"
+
+const RESCAN_NAME = "full-rescan"
+const RESCAN_USAGE = "Rehash every file instead of trusting the size, mtime and inode recorded at the last sync"
+
+const EXCLUDE_NAME = "exclude"
+const EXCLUDE_USAGE = "(repeatable) Pattern of paths not to sync, in .surfignore syntax"
+
+const SELECT_NAME = "select"
+const SELECT_USAGE = "(repeatable) Only sync this remote subtree; everything is synced if none are selected"
+
+const RECURSIVE_NAME = "r"
+const RECURSIVE_USAGE = "Sync the subdirectories of the base directory too; recorded in .surfconfig"
+
+const DRYRUN_NAME = "dry-run"
+const DRYRUN_USAGE = "Print what the sync would do without changing any files or the server"
+
+const JSON_NAME = "json"
+const JSON_USAGE = "Print the -dry-run plan as JSON"
+
+const TRACE_NAME = "trace"
+const TRACE_USAGE = "Export OpenTelemetry spans of the sync to stdout, stderr or an OTLP/HTTP collector URL such as http://localhost:4318"
+
+const TLSCA_NAME = "tls-ca"
+const TLSCA_USAGE = "Connect over TLS, trusting the servers' certificates if this CA signed them"
+
+const TLSCERT_NAME = "tls-cert"
+const TLSCERT_USAGE = "Connect over TLS and present this certificate to servers that require one"
+
+const TLSKEY_NAME = "tls-key"
+const TLSKEY_USAGE = "Private key of -tls-cert"
+
+const PROFILE_NAME = "profile"
+const PROFILE_USAGE = "Use the settings of this profile in the user's surfstore/profiles.yaml, overriding the base directory's .surfconfig"
+
+const METASTORE_NAME = "m"
+const METASTORE_USAGE = "(repeatable) MetaStore to sync with; the first one serving is used"
+
+const BLOCKSIZE_NAME = "b"
+const BLOCKSIZE_USAGE = "Size of the blocks used to fragment files, like the blockSize argument"
+
+const RECHUNK_NAME = "rechunk"
+const RECHUNK_USAGE = "Split every file into blocks of a block size other than the one the base directory was last synced with"
+
+const UPLOADLIMIT_NAME = "upload-limit"
+const UPLOADLIMIT_USAGE = "Bytes per second to upload blocks at most, e.g. 1M; 0 means unlimited"
+
+const DOWNLOADLIMIT_NAME = "download-limit"
+const DOWNLOADLIMIT_USAGE = "Bytes per second to download blocks at most, e.g. 4M; 0 means unlimited"
+
+const RETRIES_NAME = "retries"
+const RETRIES_USAGE = "Times to retry an RPC that failed because a server was unavailable or slow to answer"
+
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
 
@@ -30,6 +93,7 @@ const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
 // Exit codes
 const EX_USAGE int = 64
+const EX_SOFTWARE int = 70
 
 func main() {
 	// Custom flag Usage message
@@ -37,6 +101,25 @@ func main() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", LOGLEVEL_NAME, LOGLEVEL_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", USER_NAME, USER_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RESCAN_NAME, RESCAN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", EXCLUDE_NAME, EXCLUDE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SELECT_NAME, SELECT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RECURSIVE_NAME, RECURSIVE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DRYRUN_NAME, DRYRUN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", JSON_NAME, JSON_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TRACE_NAME, TRACE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLSCA_NAME, TLSCA_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLSCERT_NAME, TLSCERT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLSKEY_NAME, TLSKEY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PROFILE_NAME, PROFILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", METASTORE_NAME, METASTORE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", BLOCKSIZE_NAME, BLOCKSIZE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RECHUNK_NAME, RECHUNK_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", UPLOADLIMIT_NAME, UPLOADLIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DOWNLOADLIMIT_NAME, DOWNLOADLIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRIES_NAME, RETRIES_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
@@ -44,29 +127,186 @@ func main() {
 
 	// Parse command-line arguments and flags
 	debug := flag.Bool("d", false, DEBUG_USAGE)
+	logLevel := flag.String(LOGLEVEL_NAME, "", LOGLEVEL_USAGE)
+	user := flag.String("u", "", USER_USAGE)
+	fullRescan := flag.Bool("full-rescan", false, RESCAN_USAGE)
+	excludes := listFlag{}
+	flag.Var(&excludes, EXCLUDE_NAME, EXCLUDE_USAGE)
+	selectedPaths := listFlag{}
+	flag.Var(&selectedPaths, SELECT_NAME, SELECT_USAGE)
+	dryRun := flag.Bool(DRYRUN_NAME, false, DRYRUN_USAGE)
+	jsonPlan := flag.Bool(JSON_NAME, false, JSON_USAGE)
+	traceExporter := flag.String(TRACE_NAME, "", TRACE_USAGE)
+	tlsCA := flag.String(TLSCA_NAME, "", TLSCA_USAGE)
+	tlsCert := flag.String(TLSCERT_NAME, "", TLSCERT_USAGE)
+	tlsKey := flag.String(TLSKEY_NAME, "", TLSKEY_USAGE)
+	profile := flag.String(PROFILE_NAME, "", PROFILE_USAGE)
+	metaStoreAddrs := listFlag{}
+	flag.Var(&metaStoreAddrs, METASTORE_NAME, METASTORE_USAGE)
+	blockSizeFlag := flag.Int(BLOCKSIZE_NAME, 0, BLOCKSIZE_USAGE)
+	rechunk := flag.Bool(RECHUNK_NAME, false, RECHUNK_USAGE)
+	recursive := flag.Bool(RECURSIVE_NAME, false, RECURSIVE_USAGE)
+	uploadLimit := flag.String(UPLOADLIMIT_NAME, "", UPLOADLIMIT_USAGE)
+	downloadLimit := flag.String(DOWNLOADLIMIT_NAME, "", DOWNLOADLIMIT_USAGE)
+	retries := flag.Int(RETRIES_NAME, surfstore.DEFAULT_RETRIES, RETRIES_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
 	args := flag.Args()
 
-	if len(args) != ARG_COUNT {
+	// Arguments and flags override the profile, which overrides .surfconfig
+	overrides := &surfstore.ClientConfig{
+		MetaStoreAddrs: metaStoreAddrs,
+		BlockSize:      *blockSizeFlag,
+		Recursive:      *recursive,
+		User:           *user,
+		TLS:            surfstore.ClientTLSConfig{CA: *tlsCA, Cert: *tlsCert, Key: *tlsKey},
+		Limits:         surfstore.BandwidthConfig{Upload: *uploadLimit, Download: *downloadLimit},
+	}
+	var baseDir string
+	switch len(args) {
+	case ARG_COUNT:
+		overrides.MetaStoreAddrs = []string{args[0]}
+		baseDir = args[1]
+		blockSize, err := strconv.Atoi(args[2])
+		if err != nil || blockSize <= 0 {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+		overrides.BlockSize = blockSize
+	case SHORT_ARG_COUNT:
+		baseDir = args[0]
+	default:
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	baseConfig, settings, err := loadSettings(baseDir, *profile, overrides)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
 
-	hostPort := args[0]
-	baseDir := args[1]
-	blockSize, err := strconv.Atoi(args[2])
+	// Disable log outputs unless -d or -log-level ask for them
+	level, err := surfstore.LogLevelFromFlags(*debug, *logLevel)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	surfstore.SetLogLevel(level)
+	shutdownTracing, err := surfstore.InitTracing(*traceExporter, "surfstore-client")
 	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
+	rpcClient := surfstore.NewSurfstoreRPCClient("", baseDir, settings.BlockSize)
+	rpcClient.User = settings.User
+	rpcClient.FullRescan = *fullRescan
+	rpcClient.Rechunk = *rechunk
+	rpcClient.Recursive = settings.Recursive
+	rpcClient.Retries = *retries
+	rpcClient.Excludes = append(append([]string{}, settings.Ignore...), excludes...)
+	rpcClient.SelectedPaths = selectedPaths
+	if settings.TLS.CA != "" || settings.TLS.Cert != "" {
+		if rpcClient.TLSConfig, err = surfstore.LoadClientTLSConfig(settings.TLS.CA, settings.TLS.Cert, settings.TLS.Key); err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+	}
+	if rpcClient.Bandwidth, err = surfstore.NewBandwidthLimiter(settings.Limits); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	rpcClient.ChooseMetaStore(settings.MetaStoreAddrs)
+	if *dryRun {
+		if err := printPlan(rpcClient, *jsonPlan); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_SOFTWARE)
+		}
+		return
+	}
+	// The first sync of a base directory records its settings, and -r is
+	// recorded for the later ones
+	if baseConfig == nil {
+		baseConfig = settings.BaseDirConfig()
+	} else if *recursive && !baseConfig.Recursive {
+		baseConfig.Recursive = true
+	} else {
+		baseConfig = nil
+	}
+	if baseConfig != nil {
+		if err := surfstore.WriteClientConfig(baseConfig, baseDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_SOFTWARE)
+		}
+	}
+	err = surfstore.ClientSync(rpcClient)
+	if err := shutdownTracing(context.Background()); err != nil {
+		fmt.Fprintln(os.Stderr, "could not export spans:", err)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_SOFTWARE)
+	}
+}
+
+// Returns baseDir's .surfconfig, or nil if it has none, and the settings to
+// sync with: those of .surfconfig overridden by the profile and then by overrides
+func loadSettings(baseDir string, profile string, overrides *surfstore.ClientConfig) (*surfstore.ClientConfig, *surfstore.ClientConfig, error) {
+	settings := &surfstore.ClientConfig{BlockSize: DEFAULT_BLOCK_SIZE}
+	baseConfig, err := surfstore.LoadClientConfig(baseDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	if baseConfig != nil {
+		settings.Merge(baseConfig.RelativeTo(baseDir))
+	}
+	if profile != "" {
+		profileConfig, err := surfstore.LoadProfile(profile)
+		if err != nil {
+			return nil, nil, err
+		}
+		settings.Merge(profileConfig)
+	}
+	settings.Merge(overrides)
+	if len(settings.MetaStoreAddrs) == 0 {
+		return nil, nil, fmt.Errorf("no MetaStore given for %s", baseDir)
+	}
+	if settings.BlockSize <= 0 {
+		return nil, nil, fmt.Errorf("block size must be positive, not %d", settings.BlockSize)
+	}
+	return baseConfig, settings, nil
+}
 
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+func printPlan(client surfstore.RPCClient, asJSON bool) error {
+	plan, err := surfstore.PlanSync(client)
+	if err != nil {
+		return err
+	}
+	if !asJSON {
+		surfstore.PrintSyncPlan(plan)
+		return nil
 	}
-	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+// Flag that collects every value it is given
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
 }
@@ -2,23 +2,36 @@ package main
 
 import (
 	"cse224/proj4/pkg/surfstore"
+	"encoding/csv"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 // Arguments
 const ARG_COUNT int = 3
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d -o legacy|json|csv|summary -check -u user host:port baseDir blockSize"
 
 const DEBUG_NAME = "d"
 const DEBUG_USAGE = "Output log statements"
 
+const OUTPUT_NAME = "o"
+const OUTPUT_USAGE = "Output format: legacy, json, csv or summary (block counts and bytes per server)"
+
+const CHECK_NAME = "check"
+const CHECK_USAGE = "Flag blocks not on the server the consistent hash ring maps them to, blocks no file references, and referenced blocks on no server; exits 65 if any are found"
+
+const USER_NAME = "u"
+const USER_USAGE = "User whose files count as referencing blocks for -check; the MetaStore only shows a user the files they may read, so blocks of other users' files are reported as orphaned"
+
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
 
@@ -28,8 +41,18 @@ const BASEDIR_USAGE = "Base directory of the client"
 const BLOCK_NAME = "blockSize"
 const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
+// Output formats
+var OUTPUT_FORMATS = map[string]func(mapping *blockMapping, check bool) error{
+	"legacy":  printLegacy,
+	"json":    printJSON,
+	"csv":     printCSV,
+	"summary": printSummary,
+}
+
 // Exit codes
 const EX_USAGE int = 64
+const EX_DATAERR int = 65
+const EX_SOFTWARE int = 70
 
 func main() {
 	// Custom flag Usage message
@@ -37,6 +60,9 @@ func main() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", OUTPUT_NAME, OUTPUT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CHECK_NAME, CHECK_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", USER_NAME, USER_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
@@ -44,6 +70,9 @@ func main() {
 
 	// Parse command-line arguments and flags
 	debug := flag.Bool("d", false, DEBUG_USAGE)
+	output := flag.String(OUTPUT_NAME, "legacy", OUTPUT_USAGE)
+	check := flag.Bool(CHECK_NAME, false, CHECK_USAGE)
+	user := flag.String(USER_NAME, "", USER_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
@@ -53,6 +82,11 @@ func main() {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
+	printMapping, ok := OUTPUT_FORMATS[*output]
+	if !ok || (*check && *output == "legacy") {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
 
 	hostPort := args[0]
 	baseDir := args[1]
@@ -69,32 +103,201 @@ func main() {
 	}
 
 	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	PrintBlocksOnEachServer(rpcClient)
+	rpcClient.User = *user
+	mapping, err := getBlockMapping(rpcClient, *check)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_SOFTWARE)
+	}
+	if err := printMapping(mapping, *check); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_SOFTWARE)
+	}
+	if *check && mapping.hasProblems() {
+		os.Exit(EX_DATAERR)
+	}
 }
 
-func PrintBlocksOnEachServer(client surfstore.RPCClient) {
-	allAddrs := []string{}
-	err := client.GetBlockStoreAddrs(&allAddrs)
-	if err != nil {
-		log.Fatal("[Surfstore RPCClient]:", "Error During Fetching All BlockStore Addresses ", err)
+// Where a block is stored and, with -check, where it should be
+type blockLocation struct {
+	Hash              string `json:"hash"`
+	Server            string `json:"server"`
+	Size              int32  `json:"size"`
+	ResponsibleServer string `json:"responsibleServer,omitempty"`
+	Misplaced         bool   `json:"misplaced,omitempty"`
+	Orphaned          bool   `json:"orphaned,omitempty"`
+}
+
+type blockMapping struct {
+	Servers []string         `json:"servers"`
+	Blocks  []*blockLocation `json:"blocks"`
+	Missing []string         `json:"missing,omitempty"`
+	// With -check, the user whose files were checked for references. Blocks
+	// only referenced by files they may not read are reported as orphaned.
+	CheckedUser *string `json:"checkedUser,omitempty"`
+}
+
+// Says that orphaned and missing blocks are relative to the user's files
+func (mapping *blockMapping) checkScope() string {
+	return fmt.Sprintf("orphaned and missing blocks are relative to the files user %q may read, not to every file", *mapping.CheckedUser)
+}
+
+func (mapping *blockMapping) hasProblems() bool {
+	for _, block := range mapping.Blocks {
+		if block.Misplaced || block.Orphaned {
+			return true
+		}
 	}
+	return len(mapping.Missing) > 0
+}
 
-	result := "{"
-	for _, addr := range allAddrs {
-		// fmt.Println("Block Server: ", addr)
+// Lists the blocks on every block server, sorted by server and hash. With
+// check, each block is compared against the consistent hash ring and the
+// blocks referenced by the files the user can see.
+func getBlockMapping(client surfstore.RPCClient, check bool) (*blockMapping, error) {
+	mapping := &blockMapping{Servers: []string{}, Blocks: []*blockLocation{}}
+	if err := client.GetBlockStoreAddrs(&mapping.Servers); err != nil {
+		return nil, fmt.Errorf("fetching block store addresses: %v", err)
+	}
+	for _, addr := range mapping.Servers {
+		blockSizes := map[string]int32{}
+		if err := client.GetBlockSizes(addr, &blockSizes); err != nil {
+			return nil, fmt.Errorf("fetching blocks on %s: %v", addr, err)
+		}
 		hashes := []string{}
-		if err = client.GetBlockHashes(addr, &hashes); err != nil {
-			log.Fatal("[Surfstore RPCClient]:", "Error During Fetching Blocks on Block Server ", err)
+		for hash := range blockSizes {
+			hashes = append(hashes, hash)
 		}
-
+		sort.Strings(hashes)
 		for _, hash := range hashes {
-			result += "{" + hash + "," + addr + "},"
+			mapping.Blocks = append(mapping.Blocks, &blockLocation{Hash: hash, Server: addr, Size: blockSizes[hash]})
+		}
+	}
+	if !check || len(mapping.Servers) == 0 {
+		return mapping, nil
+	}
+	mapping.CheckedUser = &client.User
+
+	fileInfoMap := map[string]*surfstore.FileMetaData{}
+	if err := client.GetFileInfoMap(&fileInfoMap); err != nil {
+		return nil, fmt.Errorf("fetching file metadata: %v", err)
+	}
+	referenced := make(map[string]bool)
+	for _, fileMetaData := range fileInfoMap {
+		if len(fileMetaData.BlockHashList) == 1 && fileMetaData.BlockHashList[0] == surfstore.TOMBSTONE_HASHVALUE {
+			continue
+		}
+		for _, hash := range fileMetaData.BlockHashList {
+			referenced[hash] = true
+		}
+	}
+	// Ask the MetaStore, whose ring may weight the servers, where blocks belong
+	hashes := []string{}
+	for _, block := range mapping.Blocks {
+		hashes = append(hashes, block.Hash)
+	}
+	blockStoreMap := map[string][]string{}
+	if err := client.GetBlockStoreMap(hashes, &blockStoreMap); err != nil {
+		return nil, fmt.Errorf("fetching the responsible servers: %v", err)
+	}
+	responsibleServers := make(map[string]string)
+	for server, serverHashes := range blockStoreMap {
+		for _, hash := range serverHashes {
+			responsibleServers[hash] = server
+		}
+	}
+	stored := make(map[string]bool)
+	for _, block := range mapping.Blocks {
+		block.ResponsibleServer = responsibleServers[block.Hash]
+		block.Misplaced = block.Server != block.ResponsibleServer
+		block.Orphaned = !referenced[block.Hash]
+		stored[block.Hash] = true
+	}
+	for hash := range referenced {
+		if !stored[hash] {
+			mapping.Missing = append(mapping.Missing, hash)
 		}
 	}
-	if len(result) == 1 {
-		result = "{}"
-	} else {
-		result = result[:len(result)-1] + "}"
+	sort.Strings(mapping.Missing)
+	return mapping, nil
+}
+
+// Prints {{hash,addr},...}
+func printLegacy(mapping *blockMapping, check bool) error {
+	pairs := []string{}
+	for _, block := range mapping.Blocks {
+		pairs = append(pairs, "{"+block.Hash+","+block.Server+"}")
+	}
+	fmt.Println("{" + strings.Join(pairs, ",") + "}")
+	return nil
+}
+
+func printJSON(mapping *blockMapping, check bool) error {
+	out, err := json.MarshalIndent(mapping, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(out))
+	return nil
+}
+
+func printCSV(mapping *blockMapping, check bool) error {
+	w := csv.NewWriter(os.Stdout)
+	header := []string{"hash", "server", "size"}
+	if check {
+		header = append(header, "responsible_server", "misplaced", "orphaned")
+	}
+	if err := w.Write(header); err != nil {
+		return err
+	}
+	for _, block := range mapping.Blocks {
+		record := []string{block.Hash, block.Server, strconv.Itoa(int(block.Size))}
+		if check {
+			record = append(record, block.ResponsibleServer, strconv.FormatBool(block.Misplaced), strconv.FormatBool(block.Orphaned))
+		}
+		if err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if check && mapping.CheckedUser != nil {
+		fmt.Fprintln(os.Stderr, mapping.checkScope())
+	}
+	return w.Error()
+}
+
+func printSummary(mapping *blockMapping, check bool) error {
+	type serverSummary struct {
+		blocks, bytes, misplaced, orphaned int64
+	}
+	summaries := make(map[string]*serverSummary)
+	for _, addr := range mapping.Servers {
+		summaries[addr] = &serverSummary{}
+	}
+	for _, block := range mapping.Blocks {
+		summary := summaries[block.Server]
+		summary.blocks++
+		summary.bytes += int64(block.Size)
+		if block.Misplaced {
+			summary.misplaced++
+		}
+		if block.Orphaned {
+			summary.orphaned++
+		}
+	}
+	for _, addr := range mapping.Servers {
+		summary := summaries[addr]
+		fmt.Printf("%s\t%d blocks\t%d bytes", addr, summary.blocks, summary.bytes)
+		if check {
+			fmt.Printf("\t%d misplaced\t%d orphaned", summary.misplaced, summary.orphaned)
+		}
+		fmt.Println()
+	}
+	if check {
+		fmt.Printf("%d referenced blocks missing\n", len(mapping.Missing))
+		if mapping.CheckedUser != nil {
+			fmt.Println(mapping.checkScope())
+		}
 	}
-	fmt.Println(result)
+	return nil
 }
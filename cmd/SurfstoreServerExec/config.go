@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	Configuration file
+
+-config reads the server settings from a YAML file (JSON is valid YAML too),
+or from a TOML file if its name ends in .toml. Flags given on the command line
+override the values in the file, e.g.
+
+	service: both
+	listen: localhost:8081
+	blockStores:
+	  - addr: localhost:8081
+	    weight: 2
+	  - addr: localhost:8082
+	blockSize: 4K
+	tls:
+	  cert: server.pem
+	  key: server.key
+	limits:
+	  quotas: {alice: 10G:5G, "*": 1G:1G}
+	  maxMessageSize: 16M
+	logging:
+	  level: info
+	scrub:
+	  interval: 1h
+	  rate: 8M
+
+or, in TOML,
+
+	service = "both"
+	listen = "localhost:8081"
+	blockSize = "4K"
+	blockStores = [{addr = "localhost:8081", weight = 2}, {addr = "localhost:8082"}]
+	limits = {quotas = {alice = "10G:5G", "*" = "1G:1G"}}
+
+Durations are written like 10s or 1h and sizes like -q's, e.g. 8M or 1G.
+There is no storage setting: the stores are always kept in memory.
+*/
+
+type serverConfig struct {
+	Service         string             `yaml:"service" toml:"service"`
+	Listen          string             `yaml:"listen" toml:"listen"`
+	BlockStores     []blockStoreConfig `yaml:"blockStores" toml:"blockStores"`
+	BlockSize       string             `yaml:"blockSize" toml:"blockSize"`
+	TLS             tlsConfig          `yaml:"tls" toml:"tls"`
+	Limits          limitsConfig       `yaml:"limits" toml:"limits"`
+	Logging         loggingConfig      `yaml:"logging" toml:"logging"`
+	Metrics         string             `yaml:"metrics" toml:"metrics"`
+	Scrub           scrubFileConfig    `yaml:"scrub" toml:"scrub"`
+	HealthInterval  string             `yaml:"healthInterval" toml:"healthInterval"`
+	ShutdownTimeout string             `yaml:"shutdownTimeout" toml:"shutdownTimeout"`
+}
+
+type blockStoreConfig struct {
+	Addr string `yaml:"addr" toml:"addr"`
+	// Share of the blocks the BlockStore is responsible for; 0 means 1
+	Weight int `yaml:"weight" toml:"weight"`
+}
+
+type tlsConfig struct {
+	Cert string `yaml:"cert" toml:"cert"`
+	Key  string `yaml:"key" toml:"key"`
+	// CA that must have signed client certificates; none are required if empty
+	ClientCA string `yaml:"clientCA" toml:"clientCA"`
+	// CA the MetaStore trusts when it dials its BlockStores, which it then does over TLS
+	CA string `yaml:"ca" toml:"ca"`
+}
+
+type limitsConfig struct {
+	Quotas               map[string]string `yaml:"quotas" toml:"quotas"`
+	MaxMessageSize       string            `yaml:"maxMessageSize" toml:"maxMessageSize"`
+	MaxConcurrentStreams uint32            `yaml:"maxConcurrentStreams" toml:"maxConcurrentStreams"`
+}
+
+type loggingConfig struct {
+	Level string `yaml:"level" toml:"level"`
+	Trace string `yaml:"trace" toml:"trace"`
+}
+
+type scrubFileConfig struct {
+	Interval string `yaml:"interval" toml:"interval"`
+	Rate     string `yaml:"rate" toml:"rate"`
+}
+
+func defaultServerConfig() *serverConfig {
+	return &serverConfig{
+		Listen:          ":8080",
+		Limits:          limitsConfig{Quotas: map[string]string{}},
+		Logging:         loggingConfig{Level: "off"},
+		Scrub:           scrubFileConfig{Interval: "1h", Rate: "8M"},
+		HealthInterval:  "10s",
+		ShutdownTimeout: "30s",
+	}
+}
+
+// A setting that is not valid, and where it was set
+type configError struct {
+	field   string
+	message string
+}
+
+// Loaded settings, and where each came from for error messages
+type loadedConfig struct {
+	*serverConfig
+	filename string
+	root     *yaml.Node
+	// Keys a TOML file sets; TOML files have no root
+	tomlKeys *toml.MetaData
+	// Flag that set a field, by field path
+	flagFields map[string]string
+}
+
+func loadServerConfig(filename string) (*loadedConfig, error) {
+	config := &loadedConfig{serverConfig: defaultServerConfig(), filename: filename, flagFields: map[string]string{}}
+	if filename == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if strings.ToLower(filepath.Ext(filename)) == ".toml" {
+		tomlKeys, err := toml.Decode(string(data), config.serverConfig)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		if undecoded := tomlKeys.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown setting %s", filename, undecoded[0])
+		}
+		config.tomlKeys = &tomlKeys
+	} else {
+		config.root = &yaml.Node{}
+		if err := yaml.Unmarshal(data, config.root); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config.serverConfig); err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+	// An empty quotas: key decodes to no map at all, which -q adds to
+	if config.Limits.Quotas == nil {
+		config.Limits.Quotas = map[string]string{}
+	}
+	return config, nil
+}
+
+// Overrides the file's settings with the flags given on the command line
+func (config *loadedConfig) applyFlags(quotas quotaFlags, blockStoreAddrs []string) {
+	portFlag, localhostFlag := "", ""
+	flag.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch f.Name {
+		case "s":
+			config.setFromFlag("service", f.Name, &config.Service, value)
+		case "p":
+			portFlag = f.Value.String()
+		case "l":
+			localhostFlag = f.Value.String()
+		case "d":
+			if value == "true" && config.flagFields["logging.level"] == "" {
+				config.setFromFlag("logging.level", f.Name, &config.Logging.Level, "debug")
+			}
+		case "log-level":
+			config.setFromFlag("logging.level", f.Name, &config.Logging.Level, value)
+		case "trace":
+			config.setFromFlag("logging.trace", f.Name, &config.Logging.Trace, value)
+		case "block-size":
+			config.setFromFlag("blockSize", f.Name, &config.BlockSize, value)
+		case "metrics":
+			config.setFromFlag("metrics", f.Name, &config.Metrics, value)
+		case "scrub-interval":
+			config.setFromFlag("scrub.interval", f.Name, &config.Scrub.Interval, value)
+		case "scrub-rate":
+			config.setFromFlag("scrub.rate", f.Name, &config.Scrub.Rate, value)
+		case "health-interval":
+			config.setFromFlag("healthInterval", f.Name, &config.HealthInterval, value)
+		case "shutdown-timeout":
+			config.setFromFlag("shutdownTimeout", f.Name, &config.ShutdownTimeout, value)
+		}
+	})
+	// -p replaces the port and -l the host of the file's listen address. With
+	// -l alone an invalid address is left for resolve to report.
+	host, port, err := net.SplitHostPort(config.Listen)
+	if portFlag != "" || (localhostFlag != "" && err == nil) {
+		flagName := "l"
+		if portFlag != "" {
+			port, flagName = portFlag, "p"
+		}
+		if localhostFlag == "true" {
+			host = "localhost"
+		} else if localhostFlag == "false" {
+			host = ""
+		}
+		config.setFromFlag("listen", flagName, &config.Listen, net.JoinHostPort(host, port))
+	}
+	// -q sets the quotas of the namespaces it names, leaving the others
+	for namespace, quota := range quotas {
+		config.flagFields["limits.quotas."+namespace] = "-q"
+		config.Limits.Quotas[namespace] = fmt.Sprintf("%d:%d", quota.LogicalBytes, quota.PhysicalBytes)
+	}
+	if len(blockStoreAddrs) > 0 {
+		config.BlockStores = nil
+		for i, addr := range blockStoreAddrs {
+			config.flagFields[fmt.Sprintf("blockStores[%d].addr", i)] = "(blockStoreAddr*)"
+			config.BlockStores = append(config.BlockStores, blockStoreConfig{Addr: addr})
+		}
+	}
+}
+
+func (config *loadedConfig) setFromFlag(field string, flagName string, setting *string, value string) {
+	*setting = value
+	config.flagFields[field] = "-" + flagName
+}
+
+// Checks every setting and converts them to the server's options. The errors
+// name the line of the file or the flag each bad setting came from.
+func (config *loadedConfig) resolve() (*resolvedConfig, error) {
+	errs := []configError{}
+	fail := func(field string, format string, args ...interface{}) {
+		errs = append(errs, configError{field: field, message: fmt.Sprintf(format, args...)})
+	}
+	resolved := &resolvedConfig{serviceType: strings.ToLower(config.Service)}
+
+	if _, ok := SERVICE_TYPES[resolved.serviceType]; !ok {
+		fail("service", "must be meta, block or both, not %q", config.Service)
+	}
+	if _, _, err := net.SplitHostPort(config.Listen); err != nil {
+		fail("listen", "must be host:port: %v", err)
+	}
+	resolved.listen = config.Listen
+
+	resolved.blockStoreWeights = map[string]int{}
+	for i, blockStore := range config.BlockStores {
+		field := fmt.Sprintf("blockStores[%d]", i)
+		if _, _, err := net.SplitHostPort(blockStore.Addr); err != nil {
+			fail(field+".addr", "must be host:port: %v", err)
+			continue
+		}
+		if _, ok := resolved.blockStoreWeights[blockStore.Addr]; ok {
+			fail(field+".addr", "%s is listed more than once", blockStore.Addr)
+			continue
+		}
+		weight := blockStore.Weight
+		if weight < 0 {
+			fail(field+".weight", "must not be negative")
+		} else if weight == 0 {
+			weight = 1
+		}
+		resolved.blockStoreAddrs = append(resolved.blockStoreAddrs, blockStore.Addr)
+		resolved.blockStoreWeights[blockStore.Addr] = weight
+	}
+	if resolved.serviceType != "block" && len(config.BlockStores) == 0 {
+		fail("blockStores", "a MetaStore needs at least one BlockStore")
+	}
+
+	if config.BlockSize != "" {
+		blockSize, err := surfstore.ParseByteSize(config.BlockSize)
+		if err != nil {
+			fail("blockSize", "%v", err)
+		} else if blockSize < 0 || blockSize > math.MaxInt32 {
+			fail("blockSize", "must be between 0 and %d", math.MaxInt32)
+		}
+		resolved.blockSize = int32(blockSize)
+	}
+
+	if (config.TLS.Cert == "") != (config.TLS.Key == "") {
+		fail("tls.key", "tls.cert and tls.key must be set together")
+	} else if config.TLS.Cert != "" {
+		tlsConfig, err := surfstore.LoadServerTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.ClientCA)
+		if err != nil {
+			fail("tls.cert", "%v", err)
+		}
+		resolved.tlsConfig = tlsConfig
+	} else if config.TLS.ClientCA != "" {
+		fail("tls.clientCA", "requires tls.cert and tls.key")
+	}
+	if config.TLS.CA != "" {
+		// BlockStores that require client certificates get the server's own
+		blockStoreTLS, err := surfstore.LoadClientTLSConfig(config.TLS.CA, config.TLS.Cert, config.TLS.Key)
+		if err != nil {
+			fail("tls.ca", "%v", err)
+		}
+		resolved.blockStoreTLS = blockStoreTLS
+	}
+
+	resolved.quotas = quotaFlags{}
+	for _, namespace := range sortedNamespaces(config.Limits.Quotas) {
+		if err := resolved.quotas.Set(namespace + "=" + config.Limits.Quotas[namespace]); err != nil {
+			fail("limits.quotas."+namespace, "%v", err)
+		}
+	}
+	if config.Limits.MaxMessageSize != "" {
+		size, err := surfstore.ParseByteSize(config.Limits.MaxMessageSize)
+		if err != nil {
+			fail("limits.maxMessageSize", "%v", err)
+		}
+		resolved.maxMessageSize = int(size)
+		// Leave room for the rest of a PutBlock or GetBlock message
+		if resolved.blockSize > 0 && int64(resolved.blockSize)+1024 > size {
+			fail("limits.maxMessageSize", "is too small for %d-byte blocks", resolved.blockSize)
+		}
+	}
+	resolved.maxConcurrentStreams = config.Limits.MaxConcurrentStreams
+
+	level, err := surfstore.ParseLogLevel(config.Logging.Level)
+	if err != nil {
+		fail("logging.level", "%v", err)
+	}
+	resolved.logLevel = level
+	trace := config.Logging.Trace
+	if trace != "" && trace != "stdout" && trace != "stderr" && !strings.HasPrefix(trace, "http://") && !strings.HasPrefix(trace, "https://") {
+		fail("logging.trace", "must be stdout, stderr or an OTLP/HTTP URL, not %q", trace)
+	}
+	resolved.trace = trace
+	if config.Metrics != "" {
+		if _, _, err := net.SplitHostPort(config.Metrics); err != nil {
+			fail("metrics", "must be host:port: %v", err)
+		}
+	}
+	resolved.metricsAddr = config.Metrics
+
+	parseDuration := func(field string, value string) time.Duration {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			fail(field, "%v", err)
+		} else if duration < 0 {
+			fail(field, "must not be negative")
+		}
+		return duration
+	}
+	resolved.scrub.interval = parseDuration("scrub.interval", config.Scrub.Interval)
+	if resolved.scrub.bytesPerSecond, err = surfstore.ParseByteSize(config.Scrub.Rate); err != nil {
+		fail("scrub.rate", "%v", err)
+	}
+	resolved.healthInterval = parseDuration("healthInterval", config.HealthInterval)
+	resolved.shutdownTimeout = parseDuration("shutdownTimeout", config.ShutdownTimeout)
+
+	if len(errs) > 0 {
+		messages := []string{}
+		for _, e := range errs {
+			messages = append(messages, config.describe(e))
+		}
+		return nil, fmt.Errorf("%s", strings.Join(messages, "\n"))
+	}
+	return resolved, nil
+}
+
+// Settings checked and converted to what the server runs with
+type resolvedConfig struct {
+	serviceType          string
+	listen               string
+	blockStoreAddrs      []string
+	blockStoreWeights    map[string]int
+	blockSize            int32
+	tlsConfig            *tls.Config
+	blockStoreTLS        *tls.Config
+	quotas               quotaFlags
+	maxMessageSize       int
+	maxConcurrentStreams uint32
+	logLevel             surfstore.LogLevel
+	trace                string
+	metricsAddr          string
+	scrub                scrubConfig
+	healthInterval       time.Duration
+	shutdownTimeout      time.Duration
+}
+
+// Prefixes an error with the flag or the file and line that set the field
+func (config *loadedConfig) describe(e configError) string {
+	if flagName, ok := config.flagFields[e.field]; ok {
+		return fmt.Sprintf("%s: %s", flagName, e.message)
+	}
+	if line := lineOf(config.root, e.field); line > 0 {
+		return fmt.Sprintf("%s:%d: %s: %s", config.filename, line, e.field, e.message)
+	}
+	if config.tomlKeys != nil && config.tomlKeys.IsDefined(tomlKeyOf(e.field)...) {
+		return fmt.Sprintf("%s: %s: %s", config.filename, e.field, e.message)
+	}
+	return fmt.Sprintf("%s: %s", e.field, e.message)
+}
+
+// Returns the line of the YAML node at a path like blockStores[1].addr, or
+// of its closest ancestor in the file, or 0 if the file sets none of them
+func lineOf(root *yaml.Node, path string) int {
+	if root == nil || len(root.Content) == 0 {
+		return 0
+	}
+	node, line := root.Content[0], 0
+	for _, part := range strings.Split(strings.Replace(path, "[", ".[", -1), ".") {
+		var next *yaml.Node
+		if strings.HasPrefix(part, "[") {
+			i, err := strconv.Atoi(strings.Trim(part, "[]"))
+			if err == nil && node.Kind == yaml.SequenceNode && i < len(node.Content) {
+				next = node.Content[i]
+			}
+		} else if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == part {
+					next = node.Content[i+1]
+					line = node.Content[i].Line
+				}
+			}
+		}
+		if next == nil {
+			return line
+		}
+		node = next
+		line = node.Line
+	}
+	return line
+}
+
+// Returns the TOML key of a field path like blockStores[1].addr, up to the
+// first array index since the keys of array elements cannot be looked up
+func tomlKeyOf(path string) []string {
+	key := []string{}
+	for _, part := range strings.Split(path, ".") {
+		if i := strings.Index(part, "["); i >= 0 {
+			return append(key, part[:i])
+		}
+		key = append(key, part)
+	}
+	return key
+}
+
+func sortedNamespaces(quotas map[string]string) []string {
+	namespaces := []string{}
+	for namespace := range quotas {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	return namespaces
+}
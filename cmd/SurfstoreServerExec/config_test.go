@@ -0,0 +1,131 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes a config file named name and returns its path
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+// Parses args as the command line with the flags applyFlags reads
+func parseFlags(t *testing.T, args ...string) {
+	t.Helper()
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+	flag.CommandLine = flag.NewFlagSet("SurfstoreServerExec", flag.ContinueOnError)
+	flag.String("s", "", "")
+	flag.Int("p", 8080, "")
+	flag.Bool("l", false, "")
+	flag.String("scrub-rate", "8M", "")
+	flag.Duration("health-interval", 0, "")
+	flag.String("block-size", "", "")
+	if err := flag.CommandLine.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Loads a config file as main does, with args as the command line
+func loadConfigFile(t *testing.T, filename string, args ...string) (*resolvedConfig, error) {
+	t.Helper()
+	parseFlags(t, args...)
+	config, err := loadServerConfig(filename)
+	if err != nil {
+		return nil, err
+	}
+	config.applyFlags(quotaFlags{}, flag.Args())
+	return config.resolve()
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		content  string
+		args     []string
+		want     []string
+	}{
+		{"unknown YAML key", "s.yaml", "service: block\nbogus: 1\n", nil,
+			[]string{"s.yaml", "line 2: field bogus not found"}},
+		{"unknown TOML key", "s.toml", "service = \"block\"\nbogus = 1\n", nil,
+			[]string{"s.toml: unknown setting bogus"}},
+		{"bad duration", "s.yaml", "service: block\nhealthInterval: soon\n", nil,
+			[]string{`s.yaml:2: healthInterval: time: invalid duration "soon"`}},
+		{"bad byte size", "s.yaml", "service: block\nscrub:\n  interval: 1h\n  rate: lots\n", nil,
+			[]string{"s.yaml:4: scrub.rate: "}},
+		{"bad list element", "s.yaml", "service: both\nblockStores:\n  - addr: localhost:8081\n  - addr: nohost\n", nil,
+			[]string{"s.yaml:4: blockStores[1].addr: must be host:port"}},
+		{"every bad setting", "s.yaml", "service: block\nhealthInterval: soon\nshutdownTimeout: -1s\n", nil,
+			[]string{"s.yaml:2: healthInterval: ", "s.yaml:3: shutdownTimeout: must not be negative"}},
+		{"bad TOML duration", "s.toml", "service = \"block\"\nhealthInterval = \"soon\"\n", nil,
+			[]string{`s.toml: healthInterval: time: invalid duration "soon"`}},
+		{"bad TOML table value", "s.toml", "service = \"block\"\n[scrub]\nrate = \"lots\"\n", nil,
+			[]string{"s.toml: scrub.rate: "}},
+		{"bad flag value", "s.yaml", "service: block\nblockSize: 4K\n", []string{"-block-size", "lots"},
+			[]string{"-block-size: "}},
+	}
+	for _, test := range tests {
+		_, err := loadConfigFile(t, writeConfigFile(t, test.filename, test.content), test.args...)
+		if err == nil {
+			t.Errorf("%s: loaded without an error", test.name)
+			continue
+		}
+		for _, want := range test.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("%s: error %q does not contain %q", test.name, err, want)
+			}
+		}
+	}
+}
+
+func TestFlagsOverrideConfigFile(t *testing.T) {
+	for _, filename := range []string{"s.yaml", "s.toml"} {
+		content := "service: meta\nlisten: myhost:8081\nhealthInterval: soon\nscrub:\n  rate: 1M\n"
+		if filename == "s.toml" {
+			content = "service = \"meta\"\nlisten = \"myhost:8081\"\nhealthInterval = \"soon\"\n[scrub]\nrate = \"1M\"\n"
+		}
+		resolved, err := loadConfigFile(t, writeConfigFile(t, filename, content),
+			"-s", "block", "-p", "9000", "-health-interval", "5s", "-scrub-rate", "2M")
+		if err != nil {
+			t.Errorf("%s: %v", filename, err)
+			continue
+		}
+		if resolved.serviceType != "block" || resolved.listen != "myhost:9000" || resolved.healthInterval != 5*time.Second ||
+			resolved.scrub.bytesPerSecond != 2<<20 {
+			t.Errorf("%s: got service %s, listen %s, health interval %v and scrub rate %d, want block, myhost:9000, 5s and %d",
+				filename, resolved.serviceType, resolved.listen, resolved.healthInterval, resolved.scrub.bytesPerSecond, 2<<20)
+		}
+	}
+}
+
+func TestQuotaFlagsWithEmptyQuotas(t *testing.T) {
+	parseFlags(t)
+	filename := writeConfigFile(t, "s.yaml", "service: block\nlimits:\n  quotas:\n")
+	config, err := loadServerConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quotas := quotaFlags{}
+	if err := quotas.Set("alice=1G:1G"); err != nil {
+		t.Fatal(err)
+	}
+	config.applyFlags(quotas, nil)
+	resolved, err := config.resolve()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if quota, ok := resolved.quotas["alice"]; !ok || quota.LogicalBytes != 1<<30 {
+		t.Errorf("alice's quota is %v, want 1G:1G", quota)
+	}
+}
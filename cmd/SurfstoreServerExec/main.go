@@ -1,27 +1,35 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
 	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
+const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d -log-level <level> -q <namespace=logical:physical> -scrub-interval <duration> -scrub-rate <bytes> -metrics <host:port> -trace <exporter> -health-interval <duration> -shutdown-timeout <duration> -block-size <bytes> -config <file> (blockStoreAddr*)"
 
 // Set of valid services
 var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
 
 // Exit codes
 const EX_USAGE int = 64
+const EX_DATAERR int = 65
+const EX_SOFTWARE int = 70
 
 func main() {
 	// Custom flag Usage message
@@ -35,58 +43,257 @@ func main() {
 	}
 
 	// Parse command-line argument flags
-	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both")
-	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
-	localOnly := flag.Bool("l", false, "Only listen on localhost")
-	debug := flag.Bool("d", false, "Output log statements")
+	flag.String("s", "", "(required unless set by -config) Service Type of the Server: meta, block, both")
+	flag.Int("p", 8080, "(default = 8080) Port to accept connections")
+	flag.Bool("l", false, "Only listen on localhost")
+	flag.Bool("d", false, "Output log statements")
+	flag.String("log-level", "", "Lowest level to log: debug, info, warn, error or off (-d means debug)")
+	quotas := quotaFlags{}
+	flag.Var(quotas, "q", "(repeatable) Quota of a namespace in logical:physical bytes, e.g. alice=10G:5G; * sets the default, 0 means unlimited")
+	flag.Duration("scrub-interval", time.Hour, "Time between BlockStore scrubbing passes; 0 disables scrubbing")
+	flag.String("scrub-rate", "8M", "Bytes per second the BlockStore scrubber reads at most; 0 means unlimited")
+	flag.String("metrics", "", "Serve Prometheus metrics over HTTP at host:port/metrics")
+	flag.String("trace", "", "Export OpenTelemetry spans of handled RPCs to stdout, stderr or an OTLP/HTTP collector URL such as http://localhost:4318")
+	flag.Duration("health-interval", 10*time.Second, "Time between the MetaStore's health checks of its BlockStores; 0 checks them only when asked")
+	flag.Duration("shutdown-timeout", 30*time.Second, "Time to let in-flight RPCs finish after SIGINT or SIGTERM before cancelling them")
+	flag.String("block-size", "", "Block size clients must split files into, e.g. 4K; clients choose their own if unset. SIGHUP rereads it from -config")
+	configFile := flag.String("config", "", "YAML, JSON or TOML file of server settings; the other flags override it")
 	flag.Parse()
 
-	// Use tail arguments to hold BlockStore address
-	args := flag.Args()
-	var blockStoreAddrs []string
-	blockStoreAddrs = append(blockStoreAddrs, args...)
-	// Valid service type argument
-	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok {
+	// Flags, and tail arguments holding BlockStore addresses, override the config file
+	loadConfig := func() (*resolvedConfig, error) {
+		config, err := loadServerConfig(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		config.applyFlags(quotas, flag.Args())
+		return config.resolve()
+	}
+	options, err := loadConfig()
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		if *configFile == "" {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+		os.Exit(EX_DATAERR)
+	}
+
+	// Disable log outputs unless -d or -log-level ask for them
+	surfstore.SetLogLevel(options.logLevel)
+	shutdownTracing, err := surfstore.InitTracing(options.trace, "surfstore-"+options.serviceType)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
-
-	// Add localhost if necessary
-	addr := ""
-	if *localOnly {
-		addr += "localhost"
+	err = startServer(options, loadConfig)
+	ctx, cancel := context.WithTimeout(context.Background(), options.shutdownTimeout)
+	defer cancel()
+	if err := shutdownTracing(ctx); err != nil {
+		fmt.Fprintln(os.Stderr, "could not export spans:", err)
 	}
-	addr += ":" + strconv.Itoa(*port)
-
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_SOFTWARE)
 	}
-	startServer(addr, strings.ToLower(*service), blockStoreAddrs)
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddrs []string) error {
-	grpcServer := grpc.NewServer()
-	if serviceType == "both" {
-		metaStore := surfstore.NewMetaStore(blockStoreAddrs)
-		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
-		blockStore := surfstore.NewBlockStore()
-		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
-	} else if serviceType == "meta" {
-		metaStore := surfstore.NewMetaStore(blockStoreAddrs)
+// Serves until SIGINT or SIGTERM, then stops taking new RPCs, gives in-flight
+// ones up to options.shutdownTimeout to finish and stops the background work.
+// SIGHUP applies the block size of the settings loadConfig returns then.
+func startServer(options *resolvedConfig, loadConfig func() (*resolvedConfig, error)) error {
+	var metaStore *surfstore.MetaStore
+	var blockStore *surfstore.BlockStore
+	if options.serviceType == "both" || options.serviceType == "meta" {
+		metaStore = newMetaStore(options)
+	}
+	if options.serviceType == "both" || options.serviceType == "block" {
+		blockStore = newBlockStore(options.scrub)
+	}
+
+	metrics := surfstore.NewMetrics(metaStore, blockStore)
+	grpcServer := grpc.NewServer(serverOptionsOf(options, metrics)...)
+	healthServer := health.NewServer()
+	grpc_health_v1.RegisterHealthServer(grpcServer, healthServer)
+	if metaStore != nil {
 		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
-	} else if serviceType == "block" {
-		blockStore := surfstore.NewBlockStore()
+		healthServer.SetServingStatus(surfstore.SERVER_HEALTH_SERVICE, grpc_health_v1.HealthCheckResponse_SERVING)
+		healthServer.SetServingStatus(surfstore.METASTORE_HEALTH_SERVICE, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+	if blockStore != nil {
 		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		healthServer.SetServingStatus(surfstore.BLOCKSTORE_HEALTH_SERVICE, grpc_health_v1.HealthCheckResponse_SERVING)
+	}
+	var metricsServer *http.Server
+	if options.metricsAddr != "" {
+		metricsServer = serveMetrics(options.metricsAddr, metrics)
 	}
 
-	lis, err := net.Listen("tcp", hostAddr)
+	lis, err := net.Listen("tcp", options.listen)
 	if err != nil {
 		return fmt.Errorf("failed to listen: %v", err)
 	}
-	if err := grpcServer.Serve(lis); err != nil {
-		return fmt.Errorf("failed to serve: %v", err)
+	// Probe only once listening, as the MetaStore may be one of its own BlockStores
+	if metaStore != nil && options.healthInterval > 0 {
+		metaStore.StartHealthProbe(options.healthInterval, healthServer)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	served := make(chan error, 1)
+	go func() {
+		served <- grpcServer.Serve(lis)
+	}()
+	for draining := false; !draining; {
+		select {
+		case err := <-served:
+			return fmt.Errorf("failed to serve: %v", err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadBlockSize(metaStore, loadConfig)
+				continue
+			}
+			surfstore.Logger{}.Info("draining in-flight RPCs", "signal", sig)
+			draining = true
+		}
+	}
+	signal.Stop(signals)
+
+	// Tell health checkers to send no more RPCs while the rest drain
+	healthServer.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		grpcServer.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(options.shutdownTimeout):
+		surfstore.Logger{}.Warn("cancelling in-flight RPCs", "after", options.shutdownTimeout)
+		grpcServer.Stop()
+		<-stopped
+	}
+
+	if metaStore != nil {
+		metaStore.StopHealthProbe()
+	}
+	if blockStore != nil {
+		blockStore.StopScrubber()
+	}
+	if metricsServer != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), options.shutdownTimeout)
+		defer cancel()
+		if err := metricsServer.Shutdown(ctx); err != nil {
+			return fmt.Errorf("failed to stop serving metrics: %v", err)
+		}
+	}
+	return nil
+}
+
+// Changes the MetaStore's block size to the one in the reloaded settings,
+// which clients pick up on their next sync
+func reloadBlockSize(metaStore *surfstore.MetaStore, loadConfig func() (*resolvedConfig, error)) {
+	if metaStore == nil {
+		return
+	}
+	options, err := loadConfig()
+	if err != nil {
+		surfstore.Logger{}.Error("could not reload settings", "error", err)
+		return
+	}
+	metaStore.SetBlockSize(options.blockSize)
+}
+
+func serveMetrics(metricsAddr string, metrics *surfstore.Metrics) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	metricsServer := &http.Server{Addr: metricsAddr, Handler: mux}
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("failed to serve metrics: ", err)
+		}
+	}()
+	return metricsServer
+}
+
+// Returns the gRPC options that apply the TLS and message limits of options
+func serverOptionsOf(options *resolvedConfig, metrics *surfstore.Metrics) []grpc.ServerOption {
+	serverOptions := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(surfstore.TracingUnaryServerInterceptor, surfstore.LoggingUnaryServerInterceptor, metrics.UnaryServerInterceptor),
+	}
+	if options.tlsConfig != nil {
+		serverOptions = append(serverOptions, grpc.Creds(credentials.NewTLS(options.tlsConfig)))
+	}
+	if options.maxMessageSize > 0 {
+		serverOptions = append(serverOptions, grpc.MaxRecvMsgSize(options.maxMessageSize), grpc.MaxSendMsgSize(options.maxMessageSize))
+	}
+	if options.maxConcurrentStreams > 0 {
+		serverOptions = append(serverOptions, grpc.MaxConcurrentStreams(options.maxConcurrentStreams))
+	}
+	return serverOptions
+}
+
+func newMetaStore(options *resolvedConfig) *surfstore.MetaStore {
+	metaStore := surfstore.NewMetaStore(options.blockStoreAddrs)
+	metaStore.ConsistentHashRing = surfstore.NewWeightedConsistentHashRing(options.blockStoreWeights)
+	metaStore.BlockStoreTLS = options.blockStoreTLS
+	metaStore.BlockSize = options.blockSize
+	for namespace, quota := range options.quotas {
+		if namespace == DEFAULT_QUOTA_NAMESPACE {
+			metaStore.DefaultQuota = quota
+		} else {
+			metaStore.Quotas[namespace] = quota
+		}
+	}
+	return metaStore
+}
+
+// How often and how fast the BlockStore scrubs its blocks
+type scrubConfig struct {
+	interval       time.Duration
+	bytesPerSecond int64
+}
+
+func newBlockStore(scrub scrubConfig) *surfstore.BlockStore {
+	blockStore := surfstore.NewBlockStore()
+	if scrub.interval > 0 {
+		blockStore.StartScrubber(scrub.interval, scrub.bytesPerSecond)
+	}
+	return blockStore
+}
+
+// Namespace name that sets the quota of every namespace without its own
+const DEFAULT_QUOTA_NAMESPACE = "*"
+
+// quotaFlags collects repeated -q namespace=logical:physical flags
+type quotaFlags map[string]*surfstore.Quota
+
+func (q quotaFlags) String() string {
+	quotas := []string{}
+	for namespace, quota := range q {
+		quotas = append(quotas, fmt.Sprintf("%s=%d:%d", namespace, quota.LogicalBytes, quota.PhysicalBytes))
+	}
+	return strings.Join(quotas, ",")
+}
+
+func (q quotaFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected namespace=logical:physical, got %q", value)
+	}
+	limits := strings.SplitN(parts[1], ":", 2)
+	if len(limits) != 2 {
+		return fmt.Errorf("expected namespace=logical:physical, got %q", value)
+	}
+	quota := &surfstore.Quota{}
+	var err error
+	if quota.LogicalBytes, err = surfstore.ParseByteSize(limits[0]); err != nil {
+		return err
+	}
+	if quota.PhysicalBytes, err = surfstore.ParseByteSize(limits[1]); err != nil {
+		return err
 	}
+	q[parts[0]] = quota
 	return nil
 }
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Usage strings
+const USAGE_STRING = "./surf -d -log-level level -u user -m host:port -b blockSize -tls-ca file -tls-cert file -tls-key file -profile name <command> [args...]"
+
+const DEBUG_USAGE = "Output log statements"
+const LOGLEVEL_USAGE = "Lowest level to log: debug, info, warn, error or off (-d means debug)"
+const USER_USAGE = "User to act as"
+const ADDR_USAGE = "IP address and port of the MetaStore"
+const BLOCK_USAGE = "Size of the blocks put splits files into"
+const TLSCA_USAGE = "Connect over TLS, trusting the servers' certificates if this CA signed them"
+const TLSCERT_USAGE = "Connect over TLS and present this certificate to servers that require one"
+const TLSKEY_USAGE = "Private key of -tls-cert"
+const PROFILE_USAGE = "Use the settings of this profile in the user's surfstore/profiles.yaml; the other flags override it"
+
+// Subcommands and their arguments
+var COMMANDS = []struct {
+	name  string
+	args  string
+	usage string
+	argc  int
+	run   func(client surfstore.RPCClient, args []string) error
+}{
+	{"share", "folder user r|rw", "Grant a user read-only or read-write access to a folder", 3, share},
+	{"unshare", "folder user", "Revoke a user's access to a folder", 2, unshare},
+	{"grants", "[folder]", "List the shared folders you own or were granted", -1, grants},
+	{"quota", "", "Show the storage used by your namespace and its quota", 0, quota},
+	{"ls", "[-l] [-hashes] [-deleted] [prefix]", "List the files whose names start with prefix", -1, ls},
+	{"get", "name dest", "Download a file to dest, or into dest if it is a directory", 2, get},
+	{"put", "src name", "Upload the local file src as name", 2, put},
+	{"cat", "name", "Write a file to standard output", 1, cat},
+	{"rm", "name", "Delete a file", 1, rm},
+	{"scrub", "[blockStoreAddr]", "Show the progress and findings of the block scrubbers", -1, scrub},
+	{"status", "", "Show whether the MetaStore and its BlockStores are serving", 0, clusterStatus},
+}
+
+// Permission names accepted on the command line
+var PERMISSIONS = map[string]surfstore.Permission{
+	"r":  surfstore.Permission_READ,
+	"rw": surfstore.Permission_READ_WRITE,
+}
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_SOFTWARE int = 70
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(w, "  -%s: %v\n", f.Name, f.Usage)
+		})
+		fmt.Fprintf(w, "Commands:\n")
+		for _, cmd := range COMMANDS {
+			fmt.Fprintf(w, "  %s %s: %v\n", cmd.name, cmd.args, cmd.usage)
+		}
+	}
+
+	// Parse command-line arguments and flags
+	debug := flag.Bool("d", false, DEBUG_USAGE)
+	logLevel := flag.String("log-level", "", LOGLEVEL_USAGE)
+	user := flag.String("u", "", USER_USAGE)
+	hostPort := flag.String("m", "localhost:8080", ADDR_USAGE)
+	blockSize := flag.Int("b", 4096, BLOCK_USAGE)
+	tlsCA := flag.String("tls-ca", "", TLSCA_USAGE)
+	tlsCert := flag.String("tls-cert", "", TLSCERT_USAGE)
+	tlsKey := flag.String("tls-key", "", TLSKEY_USAGE)
+	profile := flag.String("profile", "", PROFILE_USAGE)
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// Disable log outputs unless -d or -log-level ask for them
+	level, err := surfstore.LogLevelFromFlags(*debug, *logLevel)
+	if err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	surfstore.SetLogLevel(level)
+
+	settings := &surfstore.ClientConfig{MetaStoreAddrs: []string{*hostPort}, BlockSize: *blockSize}
+	if *profile != "" {
+		profileConfig, err := surfstore.LoadProfile(*profile)
+		if err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			os.Exit(EX_USAGE)
+		}
+		settings.Merge(profileConfig)
+	}
+	overrides := &surfstore.ClientConfig{User: *user, TLS: surfstore.ClientTLSConfig{CA: *tlsCA, Cert: *tlsCert, Key: *tlsKey}}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "m":
+			overrides.MetaStoreAddrs = []string{*hostPort}
+		case "b":
+			overrides.BlockSize = *blockSize
+		}
+	})
+	settings.Merge(overrides)
+
+	rpcClient := surfstore.NewSurfstoreRPCClient("", "", settings.BlockSize)
+	rpcClient.User = settings.User
+	rpcClient.RequestID = surfstore.NewRequestID()
+	if settings.TLS.CA != "" || settings.TLS.Cert != "" {
+		if rpcClient.TLSConfig, err = surfstore.LoadClientTLSConfig(settings.TLS.CA, settings.TLS.Cert, settings.TLS.Key); err != nil {
+			fmt.Fprintln(flag.CommandLine.Output(), err)
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+	}
+	// get and put keep to the profile's bandwidth limits
+	if rpcClient.Bandwidth, err = surfstore.NewBandwidthLimiter(settings.Limits); err != nil {
+		fmt.Fprintln(flag.CommandLine.Output(), err)
+		os.Exit(EX_USAGE)
+	}
+	rpcClient.ChooseMetaStore(settings.MetaStoreAddrs)
+	for _, cmd := range COMMANDS {
+		if cmd.name != args[0] {
+			continue
+		}
+		if cmd.argc >= 0 && len(args)-1 != cmd.argc {
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+		if err := cmd.run(rpcClient, args[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "surf %s: %v\n", cmd.name, err)
+			os.Exit(EX_SOFTWARE)
+		}
+		return
+	}
+	flag.Usage()
+	os.Exit(EX_USAGE)
+}
+
+func share(client surfstore.RPCClient, args []string) error {
+	permission, ok := PERMISSIONS[args[2]]
+	if !ok {
+		return fmt.Errorf("unknown permission %q, expected r or rw", args[2])
+	}
+	var acl surfstore.FolderACL
+	if err := client.ShareFolder(args[0], args[1], permission, &acl); err != nil {
+		return err
+	}
+	printFolderACL(&acl)
+	return nil
+}
+
+func unshare(client surfstore.RPCClient, args []string) error {
+	var acl surfstore.FolderACL
+	if err := client.UnshareFolder(args[0], args[1], &acl); err != nil {
+		return err
+	}
+	printFolderACL(&acl)
+	return nil
+}
+
+func grants(client surfstore.RPCClient, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("expected at most one folder")
+	}
+	acls := []*surfstore.FolderACL{}
+	if err := client.GetFolderACLs(&acls); err != nil {
+		return err
+	}
+	for _, acl := range acls {
+		if len(args) == 1 && acl.Folder != strings.Trim(args[0], "/") {
+			continue
+		}
+		printFolderACL(acl)
+	}
+	return nil
+}
+
+func quota(client surfstore.RPCClient, args []string) error {
+	var usage surfstore.QuotaUsage
+	if err := client.GetQuotaUsage(&usage); err != nil {
+		return err
+	}
+	fmt.Printf("namespace %q\n", usage.Namespace)
+	fmt.Printf("\tlogical\t%d / %s\n", usage.LogicalBytes, quotaLimit(usage.Limit.GetLogicalBytes()))
+	fmt.Printf("\tphysical\t%d / %s\n", usage.PhysicalBytes, quotaLimit(usage.Limit.GetPhysicalBytes()))
+	return nil
+}
+
+func ls(client surfstore.RPCClient, args []string) error {
+	flags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	long := flags.Bool("l", false, "Show version, mode, size and modification time")
+	hashes := flags.Bool("hashes", false, "Show block hashes")
+	deleted := flags.Bool("deleted", false, "Include deleted files")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		return fmt.Errorf("expected at most one prefix")
+	}
+	req := &surfstore.ListFilesRequest{
+		Prefix:             strings.TrimPrefix(flags.Arg(0), "/"),
+		IncludeBlockHashes: *hashes,
+		IncludeDeleted:     *deleted,
+	}
+	for {
+		var page surfstore.FilePage
+		if err := client.ListFiles(req, &page); err != nil {
+			return err
+		}
+		for _, file := range page.Files {
+			printFile(file, *long, *hashes)
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		req.PageToken = page.NextPageToken
+	}
+}
+
+func get(client surfstore.RPCClient, args []string) error {
+	fileMetaData, err := surfstore.StatFile(client, args[0])
+	if err != nil {
+		return err
+	}
+	dest := args[1]
+	if info, err := os.Stat(dest); err == nil && info.IsDir() {
+		dest = filepath.Join(dest, path.Base(fileMetaData.Filename))
+	}
+	return surfstore.GetFile(client, fileMetaData, dest)
+}
+
+func put(client surfstore.RPCClient, args []string) error {
+	fileMetaData, err := surfstore.PutFile(client, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s version %d\n", fileMetaData.Filename, fileMetaData.Version)
+	return nil
+}
+
+func cat(client surfstore.RPCClient, args []string) error {
+	fileMetaData, err := surfstore.StatFile(client, args[0])
+	if err != nil {
+		return err
+	}
+	return surfstore.CatFile(client, fileMetaData, os.Stdout)
+}
+
+func rm(client surfstore.RPCClient, args []string) error {
+	_, err := surfstore.RemoveFile(client, args[0])
+	return err
+}
+
+func scrub(client surfstore.RPCClient, args []string) error {
+	addrs := args
+	if len(addrs) == 0 {
+		if err := client.GetBlockStoreAddrs(&addrs); err != nil {
+			return err
+		}
+	}
+	for _, addr := range addrs {
+		var status surfstore.ScrubStatus
+		if err := client.GetScrubStatus(addr, &status); err != nil {
+			return fmt.Errorf("%s: %v", addr, err)
+		}
+		fmt.Printf("%s\n", addr)
+		if !status.Enabled {
+			fmt.Printf("\tscrubbing disabled\n")
+		} else if status.Scrubbing {
+			fmt.Printf("\tscrubbing: %d of %d blocks, started %s\n", status.BlocksScanned, status.BlocksInPass, formatTime(status.PassStartedAt))
+		} else {
+			fmt.Printf("\tidle\n")
+		}
+		fmt.Printf("\t%d passes, last finished %s\n", status.Passes, formatTime(status.LastPassFinishedAt))
+		if status.BytesPerSecond > 0 {
+			fmt.Printf("\t%d bytes scanned at up to %d bytes/s\n", status.BytesScanned, status.BytesPerSecond)
+		} else {
+			fmt.Printf("\t%d bytes scanned without a rate limit\n", status.BytesScanned)
+		}
+		for _, block := range status.Quarantined {
+			fmt.Printf("\tquarantined %s (%d bytes, hashes to %s) at %s\n", block.Hash, block.BlockSize, block.ActualHash, formatTime(block.DetectedAt))
+		}
+	}
+	return nil
+}
+
+// Fails unless the MetaStore and all of its BlockStores are serving
+func clusterStatus(client surfstore.RPCClient, args []string) error {
+	var metaStoreStatus grpc_health_v1.HealthCheckResponse_ServingStatus
+	if err := client.CheckHealth(client.MetaStoreAddr, surfstore.METASTORE_HEALTH_SERVICE, &metaStoreStatus); err != nil {
+		return fmt.Errorf("MetaStore %s: %v", client.MetaStoreAddr, err)
+	}
+	fmt.Printf("MetaStore %s: %s\n", client.MetaStoreAddr, metaStoreStatus)
+
+	var health surfstore.ClusterHealth
+	if err := client.GetClusterHealth(&health); err != nil {
+		return err
+	}
+	fmt.Printf("Cluster: %s\n", health.Status)
+	for _, blockStore := range health.BlockStores {
+		fmt.Printf("%s\n", blockStore.Addr)
+		if blockStore.Serving {
+			fmt.Printf("\tserving, answered in %s at %s\n", time.Duration(blockStore.Latency), formatTime(blockStore.CheckedAt))
+		} else {
+			fmt.Printf("\tnot serving: %s, checked at %s\n", blockStore.Error, formatTime(blockStore.CheckedAt))
+		}
+	}
+	if metaStoreStatus != grpc_health_v1.HealthCheckResponse_SERVING || health.Status != surfstore.HealthStatus_HEALTHY {
+		return fmt.Errorf("cluster is %s", strings.ToLower(health.Status.String()))
+	}
+	return nil
+}
+
+func formatTime(unixNano int64) string {
+	if unixNano == 0 {
+		return "never"
+	}
+	return time.Unix(0, unixNano).Format("2006-01-02 15:04:05")
+}
+
+func printFile(file *surfstore.FileMetaData, long bool, hashes bool) {
+	name := file.Filename
+	if file.SymlinkTarget != "" {
+		name += " -> " + file.SymlinkTarget
+	}
+	if long {
+		mtime := time.Unix(0, file.Mtime).Format("2006-01-02 15:04:05")
+		if len(file.BlockHashList) == 1 && file.BlockHashList[0] == surfstore.TOMBSTONE_HASHVALUE {
+			fmt.Printf("%-10s %6d %12s %s %s\n", "deleted", file.Version, "-", strings.Repeat(" ", len(mtime)), name)
+		} else {
+			fmt.Printf("%-10s %6d %12d %s %s\n", os.FileMode(file.Mode&0777), file.Version, file.Size, mtime, name)
+		}
+	} else {
+		fmt.Println(name)
+	}
+	if hashes {
+		fmt.Printf("\t%s\n", strings.Join(file.BlockHashList, surfstore.HASH_DELIMITER))
+	}
+}
+
+func quotaLimit(limit int64) string {
+	if limit == 0 {
+		return "unlimited"
+	}
+	return strconv.FormatInt(limit, 10)
+}
+
+func printFolderACL(acl *surfstore.FolderACL) {
+	fmt.Printf("%s (owner %s)\n", acl.Folder, acl.Owner)
+	users := []string{}
+	for user := range acl.Grants {
+		users = append(users, user)
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		fmt.Printf("\t%s\t%s\n", user, acl.Grants[user])
+	}
+}
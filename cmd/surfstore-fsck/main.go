@@ -0,0 +1,325 @@
+package main
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Usage strings
+const USAGE_STRING = "./surfstore-fsck -d -u user -verify -repair -local dir -b blockSize host:port"
+
+const DEBUG_USAGE = "Output log statements"
+const USER_USAGE = "User whose files are checked; the MetaStore only shows a user the files they may read, so blocks of other users' files are reported as unreferenced"
+const VERIFY_USAGE = "Download every block and check that it hashes to its key"
+const REPAIR_USAGE = "Put missing and corrupt blocks back on their responsible server from another server or a local copy"
+const LOCAL_USAGE = "Directory of local files to take block copies from when repairing"
+const BLOCK_USAGE = "Size of the blocks the files in -local were split into"
+const ADDR_USAGE = "IP address and port of the MetaStore"
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_DATAERR int = 65
+const EX_SOFTWARE int = 70
+
+func main() {
+	// Custom flag Usage message
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(w, "  -%s: %v\n", f.Name, f.Usage)
+		})
+		fmt.Fprintf(w, "  host:port: %v\n", ADDR_USAGE)
+	}
+
+	// Parse command-line arguments and flags
+	debug := flag.Bool("d", false, DEBUG_USAGE)
+	user := flag.String("u", "", USER_USAGE)
+	verify := flag.Bool("verify", false, VERIFY_USAGE)
+	repair := flag.Bool("repair", false, REPAIR_USAGE)
+	localDir := flag.String("local", "", LOCAL_USAGE)
+	blockSize := flag.Int("b", 4096, BLOCK_USAGE)
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) != 1 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// Disable log outputs if debug flag is missing
+	if !(*debug) {
+		log.SetFlags(0)
+		log.SetOutput(ioutil.Discard)
+	}
+
+	client := surfstore.NewSurfstoreRPCClient(args[0], *localDir, *blockSize)
+	client.User = *user
+	report, err := check(client, *verify)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_SOFTWARE)
+	}
+	if *repair {
+		if err := report.repair(client, *localDir); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_SOFTWARE)
+		}
+	}
+	report.print()
+	if report.unrepaired() > 0 {
+		os.Exit(EX_DATAERR)
+	}
+}
+
+// A block that is not on its responsible server, or is stored there with
+// data that does not hash to its key
+type damagedBlock struct {
+	hash     string
+	server   string
+	corrupt  bool
+	files    []string
+	repaired string
+}
+
+type fsckReport struct {
+	// User whose files were checked, as the MetaStore only shows them theirs
+	user         string
+	files        int
+	blocks       int
+	damaged      []*damagedBlock
+	unreferenced map[string][]string
+	// Servers holding each block, whether or not they are responsible for it
+	holders map[string][]string
+}
+
+// Checks that every block referenced by the user's files is on the server
+// the MetaStore maps it to and, with verify, that every stored block hashes
+// to its key
+func check(client surfstore.RPCClient, verify bool) (*fsckReport, error) {
+	report := &fsckReport{user: client.User, unreferenced: make(map[string][]string), holders: make(map[string][]string)}
+
+	fileInfoMap := map[string]*surfstore.FileMetaData{}
+	if err := client.GetFileInfoMap(&fileInfoMap); err != nil {
+		return nil, fmt.Errorf("fetching file metadata: %v", err)
+	}
+	referenced := make(map[string][]string)
+	for filename, fileMetaData := range fileInfoMap {
+		if len(fileMetaData.BlockHashList) == 1 && fileMetaData.BlockHashList[0] == surfstore.TOMBSTONE_HASHVALUE {
+			continue
+		}
+		report.files++
+		for _, hash := range fileMetaData.BlockHashList {
+			referenced[hash] = append(referenced[hash], filename)
+		}
+	}
+	report.blocks = len(referenced)
+
+	addrs := []string{}
+	if err := client.GetBlockStoreAddrs(&addrs); err != nil {
+		return nil, fmt.Errorf("fetching block store addresses: %v", err)
+	}
+	for _, addr := range addrs {
+		hashes := []string{}
+		if err := client.GetBlockHashes(addr, &hashes); err != nil {
+			return nil, fmt.Errorf("listing blocks on %s: %v", addr, err)
+		}
+		for _, hash := range hashes {
+			report.holders[hash] = append(report.holders[hash], addr)
+			if _, ok := referenced[hash]; !ok {
+				report.unreferenced[addr] = append(report.unreferenced[addr], hash)
+			}
+		}
+	}
+
+	hashes := make([]string, 0, len(referenced))
+	for hash := range referenced {
+		hashes = append(hashes, hash)
+	}
+	blockStoreMap := map[string][]string{}
+	if len(hashes) > 0 {
+		if err := client.GetBlockStoreMap(hashes, &blockStoreMap); err != nil {
+			return nil, fmt.Errorf("mapping blocks to servers: %v", err)
+		}
+	}
+	for addr, addrHashes := range blockStoreMap {
+		present := []string{}
+		if err := client.HasBlocks(addrHashes, addr, &present); err != nil {
+			return nil, fmt.Errorf("checking blocks on %s: %v", addr, err)
+		}
+		isPresent := make(map[string]bool)
+		for _, hash := range present {
+			isPresent[hash] = true
+		}
+		for _, hash := range addrHashes {
+			if !isPresent[hash] {
+				report.damaged = append(report.damaged, &damagedBlock{hash: hash, server: addr, files: referenced[hash]})
+			}
+		}
+	}
+
+	if verify {
+		for hash, holders := range report.holders {
+			for _, addr := range holders {
+				ok, err := verifyBlock(client, hash, addr)
+				if err != nil {
+					return nil, err
+				}
+				if !ok {
+					report.damaged = append(report.damaged, &damagedBlock{hash: hash, server: addr, corrupt: true, files: referenced[hash]})
+				}
+			}
+		}
+	}
+	sort.Slice(report.damaged, func(i, j int) bool {
+		if report.damaged[i].server != report.damaged[j].server {
+			return report.damaged[i].server < report.damaged[j].server
+		}
+		return report.damaged[i].hash < report.damaged[j].hash
+	})
+	return report, nil
+}
+
+func verifyBlock(client surfstore.RPCClient, hash string, addr string) (bool, error) {
+	var block surfstore.Block
+	if err := client.GetBlock(hash, addr, &block); err != nil {
+		return false, fmt.Errorf("fetching block %s from %s: %v", hash, addr, err)
+	}
+	return surfstore.GetBlockHashString(block.BlockData) == hash, nil
+}
+
+// Puts intact copies of damaged blocks on their server, taken from the other
+// servers holding them or from the files in localDir
+func (report *fsckReport) repair(client surfstore.RPCClient, localDir string) error {
+	var localBlocks map[string][]byte
+	for _, damaged := range report.damaged {
+		var data []byte
+		for _, addr := range report.holders[damaged.hash] {
+			if addr == damaged.server {
+				continue
+			}
+			var block surfstore.Block
+			if err := client.GetBlock(damaged.hash, addr, &block); err == nil && surfstore.GetBlockHashString(block.BlockData) == damaged.hash {
+				data, damaged.repaired = block.BlockData, addr
+				break
+			}
+		}
+		if data == nil && localDir != "" {
+			if localBlocks == nil {
+				var err error
+				if localBlocks, err = readLocalBlocks(localDir, client.BlockSize, report.damaged); err != nil {
+					return err
+				}
+			}
+			if localData, ok := localBlocks[damaged.hash]; ok {
+				data, damaged.repaired = localData, localDir
+			}
+		}
+		if data == nil {
+			continue
+		}
+		var success bool
+		block := &surfstore.Block{BlockData: data, BlockSize: int32(len(data))}
+		if err := client.PutBlock(block, damaged.server, &success); err != nil || !success {
+			log.Println("Could not put block", damaged.hash, "on", damaged.server+":", err)
+			damaged.repaired = ""
+		}
+	}
+	return nil
+}
+
+// Finds the damaged blocks among the blocks of the files under dir
+func readLocalBlocks(dir string, blockSize int, damaged []*damagedBlock) (map[string][]byte, error) {
+	wanted := make(map[string]bool)
+	for _, block := range damaged {
+		wanted[block.hash] = true
+	}
+	found := make(map[string][]byte)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		for {
+			blockData := make([]byte, blockSize)
+			n, err := io.ReadFull(file, blockData)
+			if n > 0 {
+				if hash := surfstore.GetBlockHashString(blockData[:n]); wanted[hash] {
+					found[hash] = blockData[:n]
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+	})
+	return found, err
+}
+
+func (report *fsckReport) unrepaired() int {
+	count := 0
+	for _, damaged := range report.damaged {
+		if damaged.repaired == "" {
+			count++
+		}
+	}
+	return count
+}
+
+func (report *fsckReport) print() {
+	for _, damaged := range report.damaged {
+		problem := "missing"
+		if damaged.corrupt {
+			problem = "corrupt"
+		}
+		fmt.Printf("%s %s on %s (%s)\n", problem, damaged.hash, damaged.server, strings.Join(uniqueSorted(damaged.files), ", "))
+		if damaged.repaired != "" {
+			fmt.Printf("\trepaired from %s\n", damaged.repaired)
+		}
+	}
+	servers := []string{}
+	for addr := range report.unreferenced {
+		servers = append(servers, addr)
+	}
+	sort.Strings(servers)
+	unreferenced := 0
+	for _, addr := range servers {
+		hashes := report.unreferenced[addr]
+		sort.Strings(hashes)
+		for _, hash := range hashes {
+			fmt.Printf("unreferenced %s on %s\n", hash, addr)
+		}
+		unreferenced += len(hashes)
+	}
+	fmt.Printf("%d files, %d blocks: %d damaged (%d unrepaired), %d unreferenced\n",
+		report.files, report.blocks, len(report.damaged), report.unrepaired(), unreferenced)
+	fmt.Printf("checked the files user %q may read; blocks only other files reference count as unreferenced\n", report.user)
+}
+
+func uniqueSorted(values []string) []string {
+	seen := make(map[string]bool)
+	unique := []string{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
@@ -2,16 +2,22 @@ package surfstore
 
 import (
 	context "context"
+	"sync"
 
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type BlockStore struct {
-	BlockMap map[string]*Block
+	BlockMap   map[string]*Block
+	Quarantine map[string]*QuarantinedBlock
+	scrub      scrubState
+	mtx        sync.RWMutex
 	UnimplementedBlockStoreServer
 }
 
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
 	b := bs.BlockMap[blockHash.Hash]
 	if b != nil {
 		return b, nil
@@ -21,20 +27,33 @@ func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Bloc
 
 func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
 	hash := GetBlockHashString(block.BlockData)
+	// The size is the data's, whatever the client claims
+	block = &Block{BlockData: block.BlockData, BlockSize: int32(len(block.BlockData))}
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
 	bs.BlockMap[hash] = block
+	delete(bs.Quarantine, hash)
 	return &Success{Flag: true}, nil
 }
 
 // Given a list of hashes “in”, returns a list containing the
 // subset of in that are stored in the key-value store
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
 	var hashes []string
-	hashes = append(hashes, blockHashesIn.Hashes...)
+	for _, hash := range blockHashesIn.Hashes {
+		if _, ok := bs.BlockMap[hash]; ok {
+			hashes = append(hashes, hash)
+		}
+	}
 	return &BlockHashes{Hashes: hashes}, nil
 }
 
 // Return a list containing all blockHashes on this block server
 func (bs *BlockStore) GetBlockHashes(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
 	var hashes []string
 	for key := range bs.BlockMap {
 		hashes = append(hashes, key)
@@ -42,11 +61,36 @@ func (bs *BlockStore) GetBlockHashes(ctx context.Context, _ *emptypb.Empty) (*Bl
 	return &BlockHashes{Hashes: hashes}, nil
 }
 
+// Return the size of every block on this block server by its hash
+func (bs *BlockStore) GetBlockSizes(ctx context.Context, _ *emptypb.Empty) (*BlockSizes, error) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	blockSizes := make(map[string]int32)
+	for key, block := range bs.BlockMap {
+		blockSizes[key] = block.BlockSize
+	}
+	return &BlockSizes{BlockSizes: blockSizes}, nil
+}
+
+// Return the sizes of those of the given blocks that are on this block server
+func (bs *BlockStore) StatBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockSizes, error) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	blockSizes := make(map[string]int32)
+	for _, hash := range blockHashesIn.Hashes {
+		if block, ok := bs.BlockMap[hash]; ok {
+			blockSizes[hash] = int32(len(block.BlockData))
+		}
+	}
+	return &BlockSizes{BlockSizes: blockSizes}, nil
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
 func NewBlockStore() *BlockStore {
 	return &BlockStore{
-		BlockMap: map[string]*Block{},
+		BlockMap:   map[string]*Block{},
+		Quarantine: map[string]*QuarantinedBlock{},
 	}
 }
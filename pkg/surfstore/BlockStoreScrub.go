@@ -0,0 +1,160 @@
+package surfstore
+
+import (
+	context "context"
+	"sort"
+	"time"
+
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+	Block scrubbing
+
+The scrubber periodically rehashes every stored block and moves blocks whose
+data no longer matches their hash into quarantine, where they are no longer
+served. Putting an intact copy of the block takes it out of quarantine.
+*/
+
+// Progress of the scrubber, guarded by BlockStore.mtx
+type scrubState struct {
+	enabled            bool
+	scrubbing          bool
+	passes             int64
+	passStartedAt      int64
+	lastPassFinishedAt int64
+	blocksScanned      int64
+	blocksInPass       int64
+	bytesScanned       int64
+	bytesPerSecond     int64
+	stop               chan struct{}
+}
+
+// StartScrubber scrubs all blocks now and then every interval, reading at
+// most bytesPerSecond (0 means unlimited)
+func (bs *BlockStore) StartScrubber(interval time.Duration, bytesPerSecond int64) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if bs.scrub.enabled {
+		return
+	}
+	bs.scrub.enabled = true
+	bs.scrub.bytesPerSecond = bytesPerSecond
+	bs.scrub.stop = make(chan struct{})
+	go bs.scrubLoop(interval, bs.scrub.stop)
+}
+
+// StopScrubber stops the scrubber, abandoning the pass in progress
+func (bs *BlockStore) StopScrubber() {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	if !bs.scrub.enabled {
+		return
+	}
+	close(bs.scrub.stop)
+	bs.scrub.enabled = false
+	bs.scrub.scrubbing = false
+}
+
+// Returns the scrubber's progress and the blocks it quarantined
+func (bs *BlockStore) GetScrubStatus(ctx context.Context, _ *emptypb.Empty) (*ScrubStatus, error) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	status := &ScrubStatus{
+		Enabled:            bs.scrub.enabled,
+		Scrubbing:          bs.scrub.scrubbing,
+		Passes:             bs.scrub.passes,
+		PassStartedAt:      bs.scrub.passStartedAt,
+		LastPassFinishedAt: bs.scrub.lastPassFinishedAt,
+		BlocksScanned:      bs.scrub.blocksScanned,
+		BlocksInPass:       bs.scrub.blocksInPass,
+		BytesScanned:       bs.scrub.bytesScanned,
+		BytesPerSecond:     bs.scrub.bytesPerSecond,
+	}
+	for _, quarantined := range bs.Quarantine {
+		status.Quarantined = append(status.Quarantined, quarantined)
+	}
+	sort.Slice(status.Quarantined, func(i, j int) bool { return status.Quarantined[i].Hash < status.Quarantined[j].Hash })
+	return status, nil
+}
+
+func (bs *BlockStore) scrubLoop(interval time.Duration, stop chan struct{}) {
+	for {
+		if !bs.scrubPass(stop) {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Rehashes every block stored when the pass starts. Returns false if the
+// scrubber was stopped during the pass.
+func (bs *BlockStore) scrubPass(stop chan struct{}) bool {
+	bs.mtx.Lock()
+	hashes := make([]string, 0, len(bs.BlockMap))
+	for hash := range bs.BlockMap {
+		hashes = append(hashes, hash)
+	}
+	bs.scrub.scrubbing = true
+	bs.scrub.passStartedAt = time.Now().UnixNano()
+	bs.scrub.blocksScanned = 0
+	bs.scrub.blocksInPass = int64(len(hashes))
+	bytesPerSecond := bs.scrub.bytesPerSecond
+	bs.mtx.Unlock()
+
+	start := time.Now()
+	var passBytes int64
+	for _, hash := range hashes {
+		bs.mtx.RLock()
+		block := bs.BlockMap[hash]
+		bs.mtx.RUnlock()
+		if block == nil {
+			continue
+		}
+
+		actualHash := GetBlockHashString(block.BlockData)
+		bs.mtx.Lock()
+		if actualHash != hash && bs.BlockMap[hash] == block {
+			Logger{}.Warn("quarantining corrupt block", "hash", hash, "actual_hash", actualHash)
+			delete(bs.BlockMap, hash)
+			bs.Quarantine[hash] = &QuarantinedBlock{
+				Hash:       hash,
+				ActualHash: actualHash,
+				BlockSize:  int32(len(block.BlockData)),
+				DetectedAt: time.Now().UnixNano(),
+			}
+		}
+		bs.scrub.blocksScanned++
+		bs.scrub.bytesScanned += int64(len(block.BlockData))
+		bs.mtx.Unlock()
+
+		// Sleep off any time the pass is ahead of the rate limit
+		passBytes += int64(len(block.BlockData))
+		if bytesPerSecond > 0 {
+			due := time.Duration(float64(passBytes) / float64(bytesPerSecond) * float64(time.Second))
+			if wait := due - time.Since(start); wait > 0 {
+				select {
+				case <-stop:
+					return false
+				case <-time.After(wait):
+				}
+			}
+		}
+		select {
+		case <-stop:
+			return false
+		default:
+		}
+	}
+
+	bs.mtx.Lock()
+	bs.scrub.scrubbing = false
+	bs.scrub.passes++
+	bs.scrub.lastPassFinishedAt = time.Now().UnixNano()
+	bs.mtx.Unlock()
+	return true
+}
@@ -0,0 +1,80 @@
+package surfstore
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestScrubQuarantinesCorruptBlocks(t *testing.T) {
+	bs := NewBlockStore()
+	intact, corrupt := []byte("intact"), []byte("corrupt")
+	for _, data := range [][]byte{intact, corrupt} {
+		if _, err := bs.PutBlock(context.Background(), &Block{BlockData: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hash := GetBlockHashString(corrupt)
+	bs.BlockMap[hash].BlockData = []byte("rotten!")
+	if !bs.scrubPass(make(chan struct{})) {
+		t.Fatal("scrub pass was stopped")
+	}
+
+	status, err := bs.GetScrubStatus(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Passes != 1 || status.BlocksScanned != 2 || status.BlocksInPass != 2 || status.Scrubbing {
+		t.Errorf("after a pass got %d passes, %d of %d blocks scanned and scrubbing %v, want 1, 2 of 2 and false",
+			status.Passes, status.BlocksScanned, status.BlocksInPass, status.Scrubbing)
+	}
+	if len(status.Quarantined) != 1 || status.Quarantined[0].Hash != hash ||
+		status.Quarantined[0].ActualHash != GetBlockHashString([]byte("rotten!")) || status.Quarantined[0].BlockSize != 7 {
+		t.Errorf("quarantined %v, want %s with the hash and size of the rotten data", status.Quarantined, hash)
+	}
+	hashes := []string{GetBlockHashString(intact), hash}
+	if found, _ := bs.HasBlocks(context.Background(), &BlockHashes{Hashes: hashes}); !reflect.DeepEqual(found.Hashes, hashes[:1]) {
+		t.Errorf("HasBlocks found %v, want only the intact block", found.Hashes)
+	}
+
+	if _, err := bs.PutBlock(context.Background(), &Block{BlockData: corrupt}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := bs.GetScrubStatus(context.Background(), nil); len(status.Quarantined) != 0 {
+		t.Errorf("putting an intact copy left %v quarantined", status.Quarantined)
+	}
+	if block, _ := bs.GetBlock(context.Background(), &BlockHash{Hash: hash}); !bytes.Equal(block.BlockData, corrupt) {
+		t.Errorf("got block data %q after putting an intact copy, want %q", block.BlockData, corrupt)
+	}
+}
+
+func TestScrubRateLimit(t *testing.T) {
+	bs := NewBlockStore()
+	for i := 0; i < 4; i++ {
+		if _, err := bs.PutBlock(context.Background(), &Block{BlockData: bytes.Repeat([]byte{byte(i)}, 1000)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 4000 bytes at 10000 bytes per second take at least 400ms
+	bs.scrub.bytesPerSecond = 10000
+	start := time.Now()
+	if !bs.scrubPass(make(chan struct{})) {
+		t.Fatal("scrub pass was stopped")
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("pass at 10000 bytes per second took %v, want at least 400ms", elapsed)
+	}
+
+	// A stopped scrubber abandons the pass rather than sleeping it off
+	stop := make(chan struct{})
+	close(stop)
+	start = time.Now()
+	if bs.scrubPass(stop) {
+		t.Error("stopped scrub pass finished")
+	}
+	if elapsed := time.Since(start); elapsed >= 400*time.Millisecond {
+		t.Errorf("stopped pass took %v", elapsed)
+	}
+}
@@ -3,8 +3,8 @@ package surfstore
 import (
 	"crypto/sha256"
 	"encoding/hex"
-	"fmt"
 	"sort"
+	"strconv"
 )
 
 type ConsistentHashRing struct {
@@ -44,8 +44,26 @@ func NewConsistentHashRing(serverAddrs []string) *ConsistentHashRing {
 	}
 	for _, value := range serverAddrs {
 		hash := c.Hash("blockstore" + value)
-		fmt.Println("blockstore" + value)
 		c.ServerMap[hash] = value
 	}
 	return &c
 }
+
+// Gives each server as many points on the ring as its weight, so that it is
+// responsible for a proportional share of the blocks. A server of weight 1
+// keeps the single point NewConsistentHashRing gives it.
+func NewWeightedConsistentHashRing(weights map[string]int) *ConsistentHashRing {
+	c := ConsistentHashRing{
+		ServerMap: make(map[string]string),
+	}
+	for addr, weight := range weights {
+		for i := 0; i < weight; i++ {
+			key := "blockstore" + addr
+			if i > 0 {
+				key += "#" + strconv.Itoa(i)
+			}
+			c.ServerMap[c.Hash(key)] = addr
+		}
+	}
+	return &c
+}
@@ -2,7 +2,16 @@ package surfstore
 
 import (
 	context "context"
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -10,25 +19,331 @@ type MetaStore struct {
 	FileMetaMap        map[string]*FileMetaData
 	BlockStoreAddrs    []string
 	ConsistentHashRing *ConsistentHashRing
+	FolderACLs         map[string]*FolderACL
+	FileOwners         map[string]string
+	Quotas             map[string]*Quota
+	DefaultQuota       *Quota
+	Epoch              int64
+	Seq                int64
+	FileSeqs           map[string]int64
+	ACLSeq             int64
+	VersionConflicts   int64
+	BlockStoreTLS      *tls.Config
+	BlockSize          int32
+	healthProbe        healthProbeState
+	quota              quotaState
+	mtx                sync.RWMutex
 	UnimplementedMetaStoreServer
 }
 
+// Returns the files the calling user is allowed to read
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
-	return &FileInfoMap{FileInfoMap: m.FileMetaMap}, nil
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	user := userFromContext(ctx)
+	fileInfoMap := make(map[string]*FileMetaData)
+	for filename, fileMetaData := range m.FileMetaMap {
+		if m.permissionOf(user, filename) >= Permission_READ {
+			fileInfoMap[filename] = fileMetaData
+		}
+	}
+	return &FileInfoMap{FileInfoMap: fileInfoMap}, nil
+}
+
+// Returns a page of the files whose names start with req.Prefix that the
+// calling user can read, sorted by name. The page token is the name of the
+// last file of the previous page.
+func (m *MetaStore) ListFiles(ctx context.Context, req *ListFilesRequest) (*FilePage, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	user := userFromContext(ctx)
+	pageSize := req.PageSize
+	if pageSize <= 0 {
+		pageSize = DEFAULT_PAGE_SIZE
+	} else if pageSize > MAX_PAGE_SIZE {
+		pageSize = MAX_PAGE_SIZE
+	}
+
+	filenames := []string{}
+	for filename, fileMetaData := range m.FileMetaMap {
+		if !strings.HasPrefix(filename, req.Prefix) || filename <= req.PageToken {
+			continue
+		}
+		if isTombstone(fileMetaData) && !req.IncludeDeleted {
+			continue
+		}
+		if m.permissionOf(user, filename) >= Permission_READ {
+			filenames = append(filenames, filename)
+		}
+	}
+	sort.Strings(filenames)
+
+	page := &FilePage{}
+	if len(filenames) > int(pageSize) {
+		filenames = filenames[:pageSize]
+		page.NextPageToken = filenames[len(filenames)-1]
+	}
+	for _, filename := range filenames {
+		fileMetaData := proto.Clone(m.FileMetaMap[filename]).(*FileMetaData)
+		// Tombstones keep their marker so deleted files can be told apart
+		if !req.IncludeBlockHashes && !isTombstone(fileMetaData) {
+			fileMetaData.BlockHashList = nil
+			fileMetaData.BlockSizeList = nil
+		}
+		page.Files = append(page.Files, fileMetaData)
+	}
+	return page, nil
 }
 
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
+	user := userFromContext(ctx)
+	// The update is checked before its blocks are looked up, so that one
+	// that would be rejected makes no BlockStore lookups
+	m.mtx.Lock()
+	version, err := m.checkUpdate(ctx, user, fileMetaData)
+	m.mtx.Unlock()
+	if version != nil || err != nil {
+		return version, err
+	}
+	blockSizes, err := m.verifyBlockSizes([]*FileMetaData{fileMetaData})
+	if err != nil {
+		return nil, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	// Another update may have been stored while the blocks were looked up
+	if version, err := m.checkUpdate(ctx, user, fileMetaData); version != nil || err != nil {
+		return version, err
+	}
+	m.storeFile(user, fileMetaData)
+	m.cacheBlockSizes(blockSizes)
+	return &Version{Version: fileMetaData.Version}, nil
+}
+
+// Checks that user may store a file's metadata, returning version -1 if it
+// is not at the version after the current one. The caller must hold m.mtx.
+func (m *MetaStore) checkUpdate(ctx context.Context, user string, fileMetaData *FileMetaData) (*Version, error) {
 	filename := fileMetaData.Filename
+	if err := validateFilename(filename); err != nil {
+		return nil, err
+	}
+	if m.permissionOf(user, filename) < Permission_READ_WRITE {
+		return nil, status.Errorf(codes.PermissionDenied, "user %q may not write %s", user, filename)
+	}
+	if err := validateBlockSizes(fileMetaData); err != nil {
+		return nil, err
+	}
+	if err := m.checkChunking(fileMetaData); err != nil {
+		return nil, err
+	}
 	version := fileMetaData.Version
-	if _, ok := m.FileMetaMap[filename]; ok {
-		if version == m.FileMetaMap[filename].Version+1 {
-			m.FileMetaMap[filename] = fileMetaData
-		} else {
-			version = -1
+	if current, ok := m.FileMetaMap[filename]; ok && version != current.Version+1 {
+		m.VersionConflicts++
+		loggerFromContext(ctx).Info("version conflict", "file", filename, "version", version, "current", current.Version)
+		return &Version{Version: -1}, nil
+	}
+	return nil, m.checkQuota(user, fileMetaData)
+}
+
+// Applies a set of file updates atomically: either every file is at its
+// expected version (0 for a file that must not exist yet) and all of them are
+// committed at the version after it, or nothing is committed and the files
+// that conflict, that the caller may not write or that would exceed a quota
+// are reported.
+func (m *MetaStore) CommitBatch(ctx context.Context, fileUpdates *FileUpdates) (*BatchResult, error) {
+	user := userFromContext(ctx)
+	// As in UpdateFile, blocks are only looked up for a batch that would
+	// otherwise be committed
+	m.mtx.Lock()
+	result, updates, err := m.checkCommit(ctx, user, fileUpdates)
+	m.mtx.Unlock()
+	if err != nil || !result.Committed {
+		return result, err
+	}
+	blockSizes, err := m.verifyBlockSizes(updates)
+	if err != nil {
+		return nil, err
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if result, updates, err = m.checkCommit(ctx, user, fileUpdates); err != nil || !result.Committed {
+		return result, err
+	}
+	for _, update := range updates {
+		m.storeFile(user, update)
+		result.Versions[update.Filename] = update.Version
+	}
+	m.cacheBlockSizes(blockSizes)
+	return result, nil
+}
+
+// Checks a set of file updates for CommitBatch, counting the files that
+// conflict. The caller must hold m.mtx.
+func (m *MetaStore) checkCommit(ctx context.Context, user string, fileUpdates *FileUpdates) (*BatchResult, []*FileMetaData, error) {
+	result, updates, err := m.checkBatch(user, fileUpdates)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, filename := range result.Conflicts {
+		m.VersionConflicts++
+		loggerFromContext(ctx).Info("version conflict", "file", filename, "current", result.Versions[filename])
+	}
+	return result, updates, nil
+}
+
+// Tells what CommitBatch would do with a set of file updates without
+// committing them, so that a client can leave out the files that would be
+// denied, conflict or exceed a quota before uploading their blocks. Block
+// sizes are taken on the client's word since the blocks need not be stored
+// yet; CommitBatch still checks them.
+func (m *MetaStore) CheckBatch(ctx context.Context, fileUpdates *FileUpdates) (*BatchResult, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	result, _, err := m.checkBatch(userFromContext(ctx), fileUpdates)
+	return result, err
+}
+
+// Checks a set of file updates, returning the result of committing them and
+// the metadata to store. The caller must hold m.mtx.
+func (m *MetaStore) checkBatch(user string, fileUpdates *FileUpdates) (*BatchResult, []*FileMetaData, error) {
+	result := &BatchResult{Versions: map[string]int32{}}
+	updates := make([]*FileMetaData, 0, len(fileUpdates.FileUpdates))
+	for _, fileUpdate := range fileUpdates.FileUpdates {
+		fileMetaData := fileUpdate.FileMetaData
+		if fileMetaData == nil {
+			return nil, nil, status.Error(codes.InvalidArgument, "file update without metadata")
+		}
+		filename := fileMetaData.Filename
+		if _, ok := result.Versions[filename]; ok {
+			return nil, nil, status.Errorf(codes.InvalidArgument, "%s is updated more than once", filename)
+		}
+		if err := validateFilename(filename); err != nil {
+			return nil, nil, err
+		}
+		if err := validateBlockSizes(fileMetaData); err != nil {
+			return nil, nil, err
+		}
+		if err := m.checkChunking(fileMetaData); err != nil {
+			return nil, nil, err
+		}
+		currentVersion := int32(0)
+		if current, ok := m.FileMetaMap[filename]; ok {
+			currentVersion = current.Version
+		}
+		result.Versions[filename] = currentVersion
+		if m.permissionOf(user, filename) < Permission_READ_WRITE {
+			result.Denied = append(result.Denied, filename)
+		} else if currentVersion != fileUpdate.ExpectedVersion {
+			result.Conflicts = append(result.Conflicts, filename)
+		}
+
+		update := proto.Clone(fileMetaData).(*FileMetaData)
+		update.Version = fileUpdate.ExpectedVersion + 1
+		updates = append(updates, update)
+	}
+	if len(result.Denied) > 0 || len(result.Conflicts) > 0 {
+		return result, updates, nil
+	}
+	if violations := m.quotaViolations(user, updates); len(violations) > 0 {
+		result.OverQuota = map[string]string{}
+		for _, violation := range violations {
+			for _, filename := range violation.filenames {
+				result.OverQuota[filename] = fmt.Sprintf("quota exceeded: namespace %q would use %d of %d %s bytes",
+					violation.namespace, violation.used, violation.limit, violation.kind)
+			}
+		}
+		return result, updates, nil
+	}
+	result.Committed = true
+	return result, updates, nil
+}
+
+// Stores a file's metadata, charging new files to user. The caller must hold m.mtx.
+func (m *MetaStore) storeFile(user string, fileMetaData *FileMetaData) {
+	if _, ok := m.FileOwners[fileMetaData.Filename]; !ok {
+		m.FileOwners[fileMetaData.Filename] = user
+	}
+	m.chargeFile(fileMetaData.Filename, m.FileMetaMap[fileMetaData.Filename], fileMetaData)
+	m.FileMetaMap[fileMetaData.Filename] = fileMetaData
+	m.recordChange(fileMetaData.Filename)
+}
+
+// Rejects filenames that would be written outside a client's base directory
+func validateFilename(filename string) error {
+	if !validFilename(filename) {
+		return status.Errorf(codes.InvalidArgument, "invalid file name %q: must be relative, without .. and in canonical form", filename)
+	}
+	return nil
+}
+
+func validateBlockSizes(fileMetaData *FileMetaData) error {
+	if !isTombstone(fileMetaData) && len(fileMetaData.BlockSizeList) != len(fileMetaData.BlockHashList) {
+		return status.Errorf(codes.InvalidArgument, "%s has %d block hashes but %d block sizes",
+			fileMetaData.Filename, len(fileMetaData.BlockHashList), len(fileMetaData.BlockSizeList))
+	}
+	return nil
+}
+
+// Moves a file's metadata to a new name, leaving a tombstone that points to it
+// behind. The new name continues the version history of any file deleted
+// there before. Returns version -1 if the file changed since req.Version.
+func (m *MetaStore) RenameFile(ctx context.Context, req *RenameRequest) (*Version, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user := userFromContext(ctx)
+	for _, filename := range []string{req.OldFilename, req.NewFilename} {
+		if err := validateFilename(filename); err != nil {
+			return nil, err
+		}
+		if m.permissionOf(user, filename) < Permission_READ_WRITE {
+			return nil, status.Errorf(codes.PermissionDenied, "user %q may not write %s", user, filename)
+		}
+	}
+	if req.OldFilename == req.NewFilename {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot rename %s to itself", req.OldFilename)
+	}
+	old, ok := m.FileMetaMap[req.OldFilename]
+	if !ok || isTombstone(old) {
+		return nil, status.Errorf(codes.NotFound, "%s does not exist", req.OldFilename)
+	}
+	if old.Version != req.Version {
+		return &Version{Version: -1}, nil
+	}
+	version := int32(1)
+	if existing, ok := m.FileMetaMap[req.NewFilename]; ok {
+		if !isTombstone(existing) {
+			return nil, status.Errorf(codes.AlreadyExists, "%s already exists", req.NewFilename)
+		}
+		version = existing.Version + 1
+	}
+
+	renamed := proto.Clone(old).(*FileMetaData)
+	renamed.Filename = req.NewFilename
+	renamed.Version = version
+	renamed.RenamedFrom = req.OldFilename
+	renamed.RenamedTo = ""
+	tombstone := &FileMetaData{
+		Filename:      req.OldFilename,
+		Version:       old.Version + 1,
+		BlockHashList: []string{TOMBSTONE_HASHVALUE},
+		RenamedTo:     req.NewFilename,
+	}
+	_, hadOwner := m.FileOwners[req.NewFilename]
+	if !hadOwner {
+		m.FileOwners[req.NewFilename] = m.FileOwners[req.OldFilename]
+	}
+	if err := m.checkQuota(user, renamed, tombstone); err != nil {
+		if !hadOwner {
+			delete(m.FileOwners, req.NewFilename)
 		}
-	} else {
-		m.FileMetaMap[filename] = fileMetaData
+		return nil, err
 	}
+	m.chargeFile(req.NewFilename, m.FileMetaMap[req.NewFilename], renamed)
+	m.chargeFile(req.OldFilename, old, tombstone)
+	m.FileMetaMap[req.NewFilename] = renamed
+	m.FileMetaMap[req.OldFilename] = tombstone
+	m.recordChange(req.NewFilename)
+	m.recordChange(req.OldFilename)
 	return &Version{Version: version}, nil
 }
 
@@ -58,5 +373,11 @@ func NewMetaStore(blockStoreAddrs []string) *MetaStore {
 		FileMetaMap:        map[string]*FileMetaData{},
 		BlockStoreAddrs:    blockStoreAddrs,
 		ConsistentHashRing: NewConsistentHashRing(blockStoreAddrs),
+		FolderACLs:         map[string]*FolderACL{},
+		FileOwners:         map[string]string{},
+		Quotas:             map[string]*Quota{},
+		DefaultQuota:       &Quota{},
+		Epoch:              time.Now().UnixNano(),
+		FileSeqs:           map[string]int64{},
 	}
 }
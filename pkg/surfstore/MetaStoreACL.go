@@ -0,0 +1,191 @@
+package surfstore
+
+import (
+	context "context"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+	Shared folders
+
+A shared folder is a filename prefix owned by the user who first shared it.
+The owner can read and write every file under it and grants READ or
+READ_WRITE to other users. Files outside of any shared folder stay
+accessible to everyone, which keeps single-user setups working unchanged.
+Only the owner of every shared folder around a folder may share it, and an
+unshared folder only by the user who created all the files in it. When shared
+folders are nested, their owners keep access and the grants of the innermost
+one decide for everyone else.
+
+Users are only authenticated by TLS client certificates. Without them the
+user is a header the client sets, and the ACLs are advisory.
+*/
+
+// Grant a user access to a folder, creating the shared folder if needed
+func (m *MetaStore) ShareFolder(ctx context.Context, req *ShareRequest) (*FolderACL, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user := userFromContext(ctx)
+	if user == "" {
+		return nil, status.Error(codes.PermissionDenied, "anonymous users cannot share folders")
+	}
+	folder := normalizeFolder(req.Folder)
+	if folder == "" || req.User == "" {
+		return nil, status.Error(codes.InvalidArgument, "folder and user are required")
+	}
+	if req.Permission != Permission_READ && req.Permission != Permission_READ_WRITE {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot grant permission %v", req.Permission)
+	}
+
+	acl, ok := m.FolderACLs[folder]
+	if !ok {
+		if !m.mayShare(user, folder) {
+			return nil, status.Errorf(codes.PermissionDenied, "user %q may not share %s", user, folder)
+		}
+		acl = &FolderACL{Folder: folder, Owner: user, Grants: map[string]Permission{}}
+		m.FolderACLs[folder] = acl
+		m.recountUsage()
+	} else if acl.Owner != user {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is owned by %q", folder, acl.Owner)
+	}
+	if req.User == acl.Owner {
+		return nil, status.Errorf(codes.InvalidArgument, "%q already owns %s", req.User, folder)
+	}
+	acl.Grants[req.User] = req.Permission
+	m.recordACLChange()
+	return proto.Clone(acl).(*FolderACL), nil
+}
+
+// Revoke a user's access to a shared folder
+func (m *MetaStore) UnshareFolder(ctx context.Context, req *ShareRequest) (*FolderACL, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	user := userFromContext(ctx)
+	folder := normalizeFolder(req.Folder)
+	acl, ok := m.FolderACLs[folder]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "%s is not shared", folder)
+	}
+	if acl.Owner != user {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is owned by %q", folder, acl.Owner)
+	}
+	delete(acl.Grants, req.User)
+	m.recordACLChange()
+	return proto.Clone(acl).(*FolderACL), nil
+}
+
+// Returns the shared folders the calling user owns or has been granted access to
+func (m *MetaStore) GetFolderACLs(ctx context.Context, _ *emptypb.Empty) (*FolderACLs, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	user := userFromContext(ctx)
+	folderACLs := []*FolderACL{}
+	for _, acl := range m.FolderACLs {
+		if _, ok := acl.Grants[user]; ok || acl.Owner == user {
+			folderACLs = append(folderACLs, proto.Clone(acl).(*FolderACL))
+		}
+	}
+	sort.Slice(folderACLs, func(i, j int) bool {
+		return folderACLs[i].Folder < folderACLs[j].Folder
+	})
+	return &FolderACLs{FolderACLs: folderACLs}, nil
+}
+
+// Reports whether user may make folder a shared folder: user owns every
+// shared folder around and inside it, and if there are none around it, every
+// file in it. The caller must hold m.mtx.
+func (m *MetaStore) mayShare(user string, folder string) bool {
+	enclosing := m.enclosingACLs(folder)
+	for _, acl := range enclosing {
+		if acl.Owner != user {
+			return false
+		}
+	}
+	for other, acl := range m.FolderACLs {
+		if strings.HasPrefix(other, folder+FOLDER_DELIMITER) && acl.Owner != user {
+			return false
+		}
+	}
+	if len(enclosing) > 0 {
+		return true
+	}
+	for filename, owner := range m.FileOwners {
+		if filename != folder && !strings.HasPrefix(filename, folder+FOLDER_DELIMITER) {
+			continue
+		}
+		if fileMetaData, ok := m.FileMetaMap[filename]; ok && !isTombstone(fileMetaData) && owner != user {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the permission user has on filename. The caller must hold m.mtx.
+func (m *MetaStore) permissionOf(user string, filename string) Permission {
+	enclosing := m.enclosingACLs(filename)
+	if len(enclosing) == 0 {
+		return Permission_READ_WRITE
+	}
+	for _, acl := range enclosing {
+		if acl.Owner == user {
+			return Permission_READ_WRITE
+		}
+	}
+	return enclosing[len(enclosing)-1].Grants[user]
+}
+
+// Returns the innermost shared folder containing filename, or nil
+func (m *MetaStore) governingACL(filename string) *FolderACL {
+	enclosing := m.enclosingACLs(filename)
+	if len(enclosing) == 0 {
+		return nil
+	}
+	return enclosing[len(enclosing)-1]
+}
+
+// Returns the shared folders containing filename, outermost first
+func (m *MetaStore) enclosingACLs(filename string) []*FolderACL {
+	enclosing := []*FolderACL{}
+	for folder, acl := range m.FolderACLs {
+		if filename == folder || strings.HasPrefix(filename, folder+FOLDER_DELIMITER) {
+			enclosing = append(enclosing, acl)
+		}
+	}
+	sort.Slice(enclosing, func(i, j int) bool {
+		return len(enclosing[i].Folder) < len(enclosing[j].Folder)
+	})
+	return enclosing
+}
+
+func normalizeFolder(folder string) string {
+	return strings.Trim(folder, FOLDER_DELIMITER)
+}
+
+// Returns the user a request was made on behalf of, "" when anonymous. A
+// client with a verified certificate is the user its common name names.
+// Otherwise the user is whoever the client claims to be, so the ACLs only
+// keep out users who can be told apart by their certificates.
+func userFromContext(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) > 0 {
+			return tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+		}
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if users := md.Get(USER_METADATA_KEY); len(users) > 0 {
+		return users[0]
+	}
+	return ""
+}
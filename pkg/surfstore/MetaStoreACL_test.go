@@ -0,0 +1,60 @@
+package surfstore
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func userContext(user string) context.Context {
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs(USER_METADATA_KEY, user))
+}
+
+func putTestFile(t *testing.T, m *MetaStore, user string, filename string) {
+	t.Helper()
+	fileMetaData := &FileMetaData{Filename: filename, Version: 1, BlockHashList: []string{"h"}, BlockSizeList: []int32{1}}
+	if _, err := m.UpdateFile(userContext(user), fileMetaData); err != nil {
+		t.Fatalf("UpdateFile(%s) as %s: %v", filename, user, err)
+	}
+}
+
+func TestShareFolder(t *testing.T) {
+	m := NewMetaStore(nil)
+	putTestFile(t, m, "alice", "docs/a")
+	putTestFile(t, m, "bob", "mixed/b")
+	putTestFile(t, m, "alice", "mixed/a")
+	if _, err := m.ShareFolder(userContext("alice"), &ShareRequest{Folder: "docs", User: "bob", Permission: Permission_READ_WRITE}); err != nil {
+		t.Fatalf("alice sharing docs: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		user   string
+		folder string
+		code   codes.Code
+	}{
+		{"grantee shares a subfolder", "bob", "docs/sub", codes.PermissionDenied},
+		{"owner shares a subfolder", "alice", "docs/sub", codes.OK},
+		{"user claims a folder with other users' files", "alice", "mixed", codes.PermissionDenied},
+		{"user shares a folder of their own files", "bob", "bobs", codes.OK},
+		{"user shares an empty folder", "bob", "outer/inner", codes.OK},
+		{"user shares a folder around another user's shared folder", "alice", "outer", codes.PermissionDenied},
+	}
+	for _, test := range tests {
+		_, err := m.ShareFolder(userContext(test.user), &ShareRequest{Folder: test.folder, User: "carol", Permission: Permission_READ})
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+		}
+	}
+
+	// The owner of docs keeps access to a subfolder shared with others
+	if permission := m.permissionOf("alice", "docs/sub/x"); permission != Permission_READ_WRITE {
+		t.Errorf("alice has %v on docs/sub/x, want READ_WRITE", permission)
+	}
+	if permission := m.permissionOf("bob", "docs/sub/x"); permission != Permission_NONE {
+		t.Errorf("bob has %v on docs/sub/x, want none", permission)
+	}
+}
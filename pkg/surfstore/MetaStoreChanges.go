@@ -0,0 +1,46 @@
+package surfstore
+
+import (
+	context "context"
+)
+
+/*
+	Change sequence numbers
+
+Every change to the file map is numbered with the MetaStore's sequence
+number, so clients can ask for only the files changed since the last
+sequence number they saw. The epoch identifies this MetaStore's lifetime;
+sequence numbers from another epoch mean nothing and get the full map.
+*/
+
+// Returns the files the calling user can read that changed since req.Seq. The
+// full map is returned instead if req is from another epoch or folder sharing
+// has changed since, as that can change which files the user may read.
+func (m *MetaStore) GetChangesSince(ctx context.Context, req *ChangesRequest) (*FileChanges, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	user := userFromContext(ctx)
+	changes := &FileChanges{Epoch: m.Epoch, Seq: m.Seq, FileInfoMap: map[string]*FileMetaData{}}
+	changes.Full = req.Epoch != m.Epoch || req.Seq < m.ACLSeq || req.Seq > m.Seq
+	for filename, fileMetaData := range m.FileMetaMap {
+		if !changes.Full && m.FileSeqs[filename] <= req.Seq {
+			continue
+		}
+		if m.permissionOf(user, filename) >= Permission_READ {
+			changes.FileInfoMap[filename] = fileMetaData
+		}
+	}
+	return changes, nil
+}
+
+// Numbers a change to a file. The caller must hold m.mtx.
+func (m *MetaStore) recordChange(filename string) {
+	m.Seq++
+	m.FileSeqs[filename] = m.Seq
+}
+
+// Numbers a change to folder sharing. The caller must hold m.mtx.
+func (m *MetaStore) recordACLChange() {
+	m.Seq++
+	m.ACLSeq = m.Seq
+}
@@ -0,0 +1,117 @@
+package surfstore
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// Serves m on a local port until the test ends and returns its address
+func serveMetaStore(t *testing.T, m *MetaStore) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer()
+	RegisterMetaStoreServer(grpcServer, m)
+	go grpcServer.Serve(lis)
+	t.Cleanup(grpcServer.Stop)
+	return lis.Addr().String()
+}
+
+func TestGetChangesSince(t *testing.T) {
+	m := NewMetaStore(nil)
+	putTestFile(t, m, "alice", "a")
+	putTestFile(t, m, "alice", "b")
+	putTestFile(t, m, "alice", "c")
+	update := &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{"h2"}, BlockSizeList: []int32{1}}
+	if _, err := m.UpdateFile(userContext("alice"), update); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		epoch int64
+		seq   int64
+		full  bool
+		files []string
+	}{
+		{"from the start", m.Epoch, 0, false, []string{"a", "b", "c"}},
+		{"since the second file", m.Epoch, 2, false, []string{"a", "c"}},
+		{"up to date", m.Epoch, 4, false, []string{}},
+		{"first sync", 0, 0, true, []string{"a", "b", "c"}},
+		{"another epoch", m.Epoch - 1, 4, true, []string{"a", "b", "c"}},
+		{"ahead of the server", m.Epoch, 5, true, []string{"a", "b", "c"}},
+	}
+	for _, test := range tests {
+		changes, err := m.GetChangesSince(userContext("alice"), &ChangesRequest{Epoch: test.epoch, Seq: test.seq})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if changes.Epoch != m.Epoch || changes.Seq != 4 {
+			t.Errorf("%s: changes are at epoch %d, seq %d, want %d, 4", test.name, changes.Epoch, changes.Seq, m.Epoch)
+		}
+		if changes.Full != test.full {
+			t.Errorf("%s: full is %v, want %v", test.name, changes.Full, test.full)
+		}
+		if got := sortedFilenames(changes.FileInfoMap); !reflect.DeepEqual(got, test.files) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.files)
+		}
+	}
+}
+
+// Sharing a folder can change which files a user may read, so it gets the
+// full map of the files they can read now
+func TestGetChangesSinceAfterSharing(t *testing.T) {
+	m := NewMetaStore(nil)
+	putTestFile(t, m, "alice", "docs/a")
+	putTestFile(t, m, "bob", "b")
+	changes, err := m.GetChangesSince(userContext("bob"), &ChangesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.ShareFolder(userContext("alice"), &ShareRequest{Folder: "docs", User: "bob", Permission: Permission_READ}); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err = m.GetChangesSince(userContext("bob"), &ChangesRequest{Epoch: changes.Epoch, Seq: changes.Seq})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := sortedFilenames(changes.FileInfoMap), []string{"b", "docs/a"}; !changes.Full || !reflect.DeepEqual(got, want) {
+		t.Errorf("after sharing, got full %v with %v, want full with %v", changes.Full, got, want)
+	}
+}
+
+// A restarted MetaStore starts a new epoch, and a client's remote index from
+// the old one is replaced rather than merged, even when the new MetaStore's
+// sequence number has passed the client's
+func TestRefreshRemoteIndexAfterRestart(t *testing.T) {
+	before := NewMetaStore(nil)
+	putTestFile(t, before, "", "a")
+	putTestFile(t, before, "", "b")
+	client := RPCClient{MetaStoreAddr: serveMetaStore(t, before)}
+	remoteIndex := &RemoteIndex{FileMetaMap: map[string]*FileMetaData{}}
+	if err := refreshRemoteIndex(client, remoteIndex); err != nil {
+		t.Fatal(err)
+	}
+
+	after := NewMetaStore(nil)
+	after.Epoch = before.Epoch + 1
+	putTestFile(t, after, "", "c")
+	putTestFile(t, after, "", "d")
+	putTestFile(t, after, "", "e")
+	client.MetaStoreAddr = serveMetaStore(t, after)
+	if err := refreshRemoteIndex(client, remoteIndex); err != nil {
+		t.Fatal(err)
+	}
+	if remoteIndex.Epoch != after.Epoch || remoteIndex.Seq != after.Seq {
+		t.Errorf("remote index is at epoch %d, seq %d, want %d, %d", remoteIndex.Epoch, remoteIndex.Seq, after.Epoch, after.Seq)
+	}
+	if got, want := sortedFilenames(remoteIndex.FileMetaMap), []string{"c", "d", "e"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("remote index has %v, want %v", got, want)
+	}
+}
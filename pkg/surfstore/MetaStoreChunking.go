@@ -0,0 +1,52 @@
+package surfstore
+
+import (
+	context "context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+	Chunking
+
+Clients that split the same file into blocks of different sizes see different
+block hashes and keep uploading it anew. A MetaStore with a BlockSize tells
+clients to use it and rejects files split into blocks of any other size.
+Files stored before the block size changed keep their blocks; clients re-chunk
+the files of a base directory synced with the old size on their next sync.
+*/
+
+// Returns the block size clients must use, or 0 if they may choose
+func (m *MetaStore) GetChunkingParams(ctx context.Context, _ *emptypb.Empty) (*ChunkingParams, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	return &ChunkingParams{BlockSize: m.BlockSize}, nil
+}
+
+// SetBlockSize changes the block size clients must use; 0 lets them choose
+func (m *MetaStore) SetBlockSize(blockSize int32) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if blockSize != m.BlockSize {
+		Logger{}.Info("block size changed", "from", m.BlockSize, "to", blockSize)
+	}
+	m.BlockSize = blockSize
+}
+
+// Fails unless every block of a file but the last is BlockSize bytes and the
+// last no larger. The caller must hold m.mtx.
+func (m *MetaStore) checkChunking(fileMetaData *FileMetaData) error {
+	if m.BlockSize == 0 {
+		return nil
+	}
+	blockSizes := fileMetaData.BlockSizeList
+	for i, blockSize := range blockSizes {
+		if blockSize > m.BlockSize || (blockSize < m.BlockSize && i < len(blockSizes)-1) {
+			return status.Errorf(codes.FailedPrecondition, "%s is split into %d-byte blocks, not the cluster's %d; re-chunk it",
+				fileMetaData.Filename, blockSize, m.BlockSize)
+		}
+	}
+	return nil
+}
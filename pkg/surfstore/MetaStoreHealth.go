@@ -0,0 +1,190 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/tls"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+	Health probing
+
+The MetaStore periodically asks each of its BlockStores whether it is serving
+through the gRPC health service. The cluster is healthy while all of them are,
+degraded while only some are and unhealthy once none are, in which case the
+MetaStore reports itself as not serving too.
+*/
+
+// How long the MetaStore waits for a BlockStore to answer a health check
+const HEALTH_PROBE_TIMEOUT = time.Second
+
+// Progress of the health probe, guarded by MetaStore.mtx
+type healthProbeState struct {
+	enabled     bool
+	blockStores map[string]*BlockStoreHealth
+	stop        chan struct{}
+}
+
+// StartHealthProbe probes the BlockStores now and then every interval, and
+// reports the outcome to healthServer if it is not nil
+func (m *MetaStore) StartHealthProbe(interval time.Duration, healthServer *health.Server) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if m.healthProbe.enabled {
+		return
+	}
+	m.healthProbe.enabled = true
+	m.healthProbe.stop = make(chan struct{})
+	go m.healthProbeLoop(interval, healthServer, m.healthProbe.stop)
+}
+
+// StopHealthProbe stops probing the BlockStores
+func (m *MetaStore) StopHealthProbe() {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if !m.healthProbe.enabled {
+		return
+	}
+	close(m.healthProbe.stop)
+	m.healthProbe.enabled = false
+}
+
+// Returns the outcome of the last probe of each BlockStore, probing them now
+// if the health probe is not running
+func (m *MetaStore) GetClusterHealth(ctx context.Context, _ *emptypb.Empty) (*ClusterHealth, error) {
+	m.mtx.RLock()
+	enabled := m.healthProbe.enabled
+	m.mtx.RUnlock()
+	if !enabled {
+		m.probeBlockStores(nil)
+	}
+
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	clusterHealth := &ClusterHealth{}
+	for _, addr := range m.BlockStoreAddrs {
+		blockStoreHealth, ok := m.healthProbe.blockStores[addr]
+		if !ok {
+			blockStoreHealth = &BlockStoreHealth{Addr: addr, Error: "not probed yet"}
+		}
+		clusterHealth.BlockStores = append(clusterHealth.BlockStores, blockStoreHealth)
+	}
+	clusterHealth.Status = clusterStatusOf(clusterHealth.BlockStores)
+	return clusterHealth, nil
+}
+
+func (m *MetaStore) healthProbeLoop(interval time.Duration, healthServer *health.Server, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		m.probeBlockStores(healthServer)
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Checks every BlockStore at once and records the outcome
+func (m *MetaStore) probeBlockStores(healthServer *health.Server) {
+	results := make([]*BlockStoreHealth, len(m.BlockStoreAddrs))
+	var wg sync.WaitGroup
+	for i, addr := range m.BlockStoreAddrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			results[i] = probeBlockStore(addr, m.BlockStoreTLS)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	m.mtx.Lock()
+	probed := m.probedBlockStores()
+	previous := clusterStatusOf(probed)
+	if m.healthProbe.blockStores == nil {
+		m.healthProbe.blockStores = map[string]*BlockStoreHealth{}
+	}
+	for _, result := range results {
+		if old, ok := m.healthProbe.blockStores[result.Addr]; ok && old.Serving && !result.Serving {
+			Logger{}.Warn("block store unreachable", "addr", result.Addr, "error", result.Error)
+		}
+		m.healthProbe.blockStores[result.Addr] = result
+	}
+	current := clusterStatusOf(results)
+	m.mtx.Unlock()
+
+	if len(probed) > 0 && current != previous {
+		Logger{}.Info("cluster health changed", "from", previous, "to", current)
+	}
+	if healthServer == nil {
+		return
+	}
+	metaStoreStatus := grpc_health_v1.HealthCheckResponse_SERVING
+	if current == HealthStatus_UNHEALTHY {
+		metaStoreStatus = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	clusterStatus := grpc_health_v1.HealthCheckResponse_SERVING
+	if current != HealthStatus_HEALTHY {
+		clusterStatus = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	healthServer.SetServingStatus(SERVER_HEALTH_SERVICE, metaStoreStatus)
+	healthServer.SetServingStatus(METASTORE_HEALTH_SERVICE, metaStoreStatus)
+	healthServer.SetServingStatus(CLUSTER_HEALTH_SERVICE, clusterStatus)
+}
+
+// Returns the last probe of each BlockStore. The caller must hold m.mtx.
+func (m *MetaStore) probedBlockStores() []*BlockStoreHealth {
+	blockStores := []*BlockStoreHealth{}
+	for _, addr := range m.BlockStoreAddrs {
+		if blockStoreHealth, ok := m.healthProbe.blockStores[addr]; ok {
+			blockStores = append(blockStores, blockStoreHealth)
+		}
+	}
+	return blockStores
+}
+
+func probeBlockStore(addr string, tlsConfig *tls.Config) *BlockStoreHealth {
+	result := &BlockStoreHealth{Addr: addr, CheckedAt: time.Now().UnixNano()}
+	start := time.Now()
+	conn, err := grpc.Dial(addr, transportOption(tlsConfig))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), HEALTH_PROBE_TIMEOUT)
+	defer cancel()
+	resp, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: BLOCKSTORE_HEALTH_SERVICE})
+	result.Latency = int64(time.Since(start))
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Serving = resp.Status == grpc_health_v1.HealthCheckResponse_SERVING
+	if !result.Serving {
+		result.Error = resp.Status.String()
+	}
+	return result
+}
+
+func clusterStatusOf(blockStores []*BlockStoreHealth) HealthStatus {
+	serving := 0
+	for _, blockStoreHealth := range blockStores {
+		if blockStoreHealth.Serving {
+			serving++
+		}
+	}
+	if serving == 0 {
+		return HealthStatus_UNHEALTHY
+	} else if serving < len(blockStores) {
+		return HealthStatus_DEGRADED
+	}
+	return HealthStatus_HEALTHY
+}
@@ -0,0 +1,33 @@
+package surfstore
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthProbeReportsServer(t *testing.T) {
+	// A port nothing listens on once the listener is closed
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	m := NewMetaStore([]string{addr})
+	healthServer := health.NewServer()
+	m.probeBlockStores(healthServer)
+	for _, service := range []string{SERVER_HEALTH_SERVICE, METASTORE_HEALTH_SERVICE, CLUSTER_HEALTH_SERVICE} {
+		resp, err := healthServer.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: service})
+		if err != nil {
+			t.Fatalf("checking %q: %v", service, err)
+		}
+		if resp.Status != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("%q is %v with no BlockStore serving, want NOT_SERVING", service, resp.Status)
+		}
+	}
+}
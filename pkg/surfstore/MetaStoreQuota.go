@@ -0,0 +1,400 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+/*
+	Storage quotas
+
+Every file is charged to a namespace: the owner of the shared folder it is
+in, or otherwise the user who created it. A namespace is limited in logical
+bytes (the sum of its file sizes) and physical bytes (the size of the unique
+blocks its files reference). A limit of 0 means unlimited.
+
+The usage of every namespace is counted as files are stored rather than
+recomputed for each update. Block sizes are not taken on the client's word:
+before a file is stored, the BlockStores responsible for its blocks are asked
+for their sizes, which have to match the ones the client sent.
+*/
+
+// Usage counters of the namespaces, guarded by MetaStore.mtx
+type quotaState struct {
+	usage map[string]*namespaceUsage
+	// Namespace each stored file is charged to
+	namespaces map[string]string
+	// Sizes of the blocks stored files reference, as their BlockStores
+	// reported them
+	blockSizes map[string]int32
+	// Looks up the sizes of blocks on a BlockStore; nil asks it over gRPC
+	statBlocks func(addr string, hashes []string) (map[string]int32, error)
+}
+
+type namespaceUsage struct {
+	logicalBytes  int64
+	physicalBytes int64
+	// Number of the namespace's files referencing each block
+	blockRefs map[string]int
+}
+
+// Returns the usage and limits of the calling user's namespace
+func (m *MetaStore) GetQuotaUsage(ctx context.Context, _ *emptypb.Empty) (*QuotaUsage, error) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	user := userFromContext(ctx)
+	usage := &QuotaUsage{Namespace: user, Limit: m.limitOf(user)}
+	if counters, ok := m.quota.usage[user]; ok {
+		usage.LogicalBytes = counters.logicalBytes
+		usage.PhysicalBytes = counters.physicalBytes
+	}
+	return usage, nil
+}
+
+// Rejects updates that would grow a namespace beyond its quota. Updates that
+// shrink a namespace are let through even if it is still over quota.
+func (m *MetaStore) checkQuota(user string, updates ...*FileMetaData) error {
+	violations := m.quotaViolations(user, updates)
+	if len(violations) == 0 {
+		return nil
+	}
+	messages := []string{}
+	for _, violation := range violations {
+		messages = append(messages, fmt.Sprintf("%s would use %d of %d %s bytes",
+			strings.Join(violation.filenames, ", "), violation.used, violation.limit, violation.kind))
+	}
+	return status.Errorf(codes.ResourceExhausted, "quota exceeded: %s", strings.Join(messages, "; "))
+}
+
+// A namespace that a set of updates would take beyond its quota
+type quotaViolation struct {
+	namespace string
+	kind      string
+	used      int64
+	limit     int64
+	// The updates that grow the namespace in that kind of bytes
+	filenames []string
+}
+
+// Returns why the updates cannot all be committed, if they cannot
+func (m *MetaStore) quotaViolations(user string, updates []*FileMetaData) []*quotaViolation {
+	deltas := make(map[string]*usageDelta)
+	deltaOf := func(namespace string) *usageDelta {
+		if _, ok := deltas[namespace]; !ok {
+			deltas[namespace] = &usageDelta{blockRefs: map[string]int{}, blockSizes: map[string]int32{}}
+		}
+		return deltas[namespace]
+	}
+	for _, fileMetaData := range updates {
+		current, exists := m.FileMetaMap[fileMetaData.Filename]
+		if exists {
+			deltaOf(m.quota.namespaces[fileMetaData.Filename]).add(current, -1)
+		}
+		delta := deltaOf(m.namespaceOf(user, fileMetaData.Filename))
+		delta.add(fileMetaData, 1)
+		delta.updates = append(delta.updates, fileMetaData)
+	}
+
+	violations := []*quotaViolation{}
+	for namespace, delta := range deltas {
+		counters := m.quota.usage[namespace]
+		if counters == nil {
+			counters = &namespaceUsage{}
+		}
+		physical := int64(0)
+		for hash, refs := range delta.blockRefs {
+			before := counters.blockRefs[hash]
+			if before == 0 && refs > 0 {
+				physical += int64(delta.blockSizes[hash])
+			} else if before > 0 && before+refs == 0 {
+				physical -= int64(delta.blockSizes[hash])
+			}
+		}
+		limit := m.limitOf(namespace)
+		if used := counters.logicalBytes + delta.logicalBytes; limit.LogicalBytes > 0 && delta.logicalBytes > 0 && used > limit.LogicalBytes {
+			violations = append(violations, &quotaViolation{namespace: namespace, kind: "logical", used: used, limit: limit.LogicalBytes,
+				filenames: m.overQuotaUpdates(delta.updates, used-limit.LogicalBytes, func(update *FileMetaData, current *FileMetaData) int64 {
+					return logicalSizeOf(update) - logicalSizeOf(current)
+				})})
+		}
+		if used := counters.physicalBytes + physical; limit.PhysicalBytes > 0 && physical > 0 && used > limit.PhysicalBytes {
+			violations = append(violations, &quotaViolation{namespace: namespace, kind: "physical", used: used, limit: limit.PhysicalBytes,
+				filenames: m.overQuotaUpdates(delta.updates, used-limit.PhysicalBytes, func(update *FileMetaData, _ *FileMetaData) int64 {
+					growth := int64(0)
+					for i, hash := range update.BlockHashList {
+						if counters.blockRefs[hash] == 0 && i < len(update.BlockSizeList) {
+							growth += int64(update.BlockSizeList[i])
+						}
+					}
+					return growth
+				})})
+		}
+	}
+	sort.Slice(violations, func(i, j int) bool {
+		return violations[i].namespace < violations[j].namespace
+	})
+	return violations
+}
+
+// Returns the names of the updates to leave out so that a namespace shrinks
+// by excess bytes: the ones that grow it the most, by growth's measure. If
+// that is not enough on its own, as when updates share new blocks, every
+// update that grows the namespace is returned, and every update other than a
+// deletion if none do.
+func (m *MetaStore) overQuotaUpdates(updates []*FileMetaData, excess int64, growth func(update *FileMetaData, current *FileMetaData) int64) []string {
+	type growingUpdate struct {
+		filename string
+		growth   int64
+	}
+	growing, all := []growingUpdate{}, []string{}
+	for _, update := range updates {
+		if isTombstone(update) {
+			continue
+		}
+		all = append(all, update.Filename)
+		current, ok := m.FileMetaMap[update.Filename]
+		if !ok {
+			current = &FileMetaData{}
+		}
+		if bytes := growth(update, current); bytes > 0 {
+			growing = append(growing, growingUpdate{update.Filename, bytes})
+		}
+	}
+	if len(growing) == 0 {
+		return all
+	}
+	sort.Slice(growing, func(i, j int) bool {
+		if growing[i].growth != growing[j].growth {
+			return growing[i].growth > growing[j].growth
+		}
+		return growing[i].filename < growing[j].filename
+	})
+	filenames := []string{}
+	for _, update := range growing {
+		filenames = append(filenames, update.filename)
+		excess -= update.growth
+		if excess <= 0 {
+			return filenames
+		}
+	}
+	return filenames
+}
+
+func logicalSizeOf(fileMetaData *FileMetaData) int64 {
+	size := int64(0)
+	if !isTombstone(fileMetaData) {
+		for _, blockSize := range fileMetaData.BlockSizeList {
+			size += int64(blockSize)
+		}
+	}
+	return size
+}
+
+// How a set of updates changes the usage of a namespace
+type usageDelta struct {
+	logicalBytes int64
+	blockRefs    map[string]int
+	blockSizes   map[string]int32
+	updates      []*FileMetaData
+}
+
+func (delta *usageDelta) add(fileMetaData *FileMetaData, sign int) {
+	if isTombstone(fileMetaData) {
+		return
+	}
+	for i, size := range fileMetaData.BlockSizeList {
+		hash := fileMetaData.BlockHashList[i]
+		delta.logicalBytes += int64(sign) * int64(size)
+		delta.blockRefs[hash] += sign
+		delta.blockSizes[hash] = size
+	}
+}
+
+// Returns the quota of a namespace
+func (m *MetaStore) limitOf(namespace string) *Quota {
+	if limit, ok := m.Quotas[namespace]; ok {
+		return limit
+	}
+	return m.DefaultQuota
+}
+
+// Returns the namespace a file is charged to. New files are charged to the
+// user creating them.
+func (m *MetaStore) namespaceOf(user string, filename string) string {
+	if acl := m.governingACL(filename); acl != nil {
+		return acl.Owner
+	}
+	if owner, ok := m.FileOwners[filename]; ok {
+		return owner
+	}
+	return user
+}
+
+// Moves the usage of a file from the namespace it was charged to over to the
+// one it is charged to now, replacing previous with current; either may be
+// nil. The caller must hold m.mtx.
+func (m *MetaStore) chargeFile(filename string, previous *FileMetaData, current *FileMetaData) {
+	if m.quota.usage == nil {
+		m.quota.usage = map[string]*namespaceUsage{}
+		m.quota.namespaces = map[string]string{}
+	}
+	if previous != nil {
+		m.quota.charge(m.quota.namespaces[filename], previous, -1)
+	}
+	if current != nil {
+		namespace := m.namespaceOf(m.FileOwners[filename], filename)
+		m.quota.charge(namespace, current, 1)
+		m.quota.namespaces[filename] = namespace
+	}
+	// Sizes of blocks no file references any more are forgotten
+	if previous != nil && !isTombstone(previous) {
+		for _, hash := range previous.BlockHashList {
+			if !m.quota.referenced(hash) {
+				delete(m.quota.blockSizes, hash)
+			}
+		}
+	}
+}
+
+func (q *quotaState) charge(namespace string, fileMetaData *FileMetaData, sign int) {
+	if isTombstone(fileMetaData) {
+		return
+	}
+	counters, ok := q.usage[namespace]
+	if !ok {
+		counters = &namespaceUsage{blockRefs: map[string]int{}}
+		q.usage[namespace] = counters
+	}
+	for i, size := range fileMetaData.BlockSizeList {
+		hash := fileMetaData.BlockHashList[i]
+		counters.logicalBytes += int64(sign) * int64(size)
+		before := counters.blockRefs[hash]
+		counters.blockRefs[hash] += sign
+		if before == 0 && counters.blockRefs[hash] > 0 {
+			counters.physicalBytes += int64(size)
+		} else if before > 0 && counters.blockRefs[hash] == 0 {
+			counters.physicalBytes -= int64(size)
+			delete(counters.blockRefs, hash)
+		}
+	}
+}
+
+// Counts the usage of every namespace anew, for when sharing a folder changes
+// which namespace files are charged to. The caller must hold m.mtx.
+func (m *MetaStore) recountUsage() {
+	m.quota.usage = map[string]*namespaceUsage{}
+	m.quota.namespaces = map[string]string{}
+	for filename, fileMetaData := range m.FileMetaMap {
+		m.chargeFile(filename, nil, fileMetaData)
+	}
+}
+
+// Fails unless the BlockStores hold every block of the given files at the
+// size the file lists for it, and returns the sizes it looked up. Blocks of
+// stored files are not looked up again. The caller must not hold m.mtx.
+func (m *MetaStore) verifyBlockSizes(fileMetaDatas []*FileMetaData) (map[string]int32, error) {
+	m.mtx.RLock()
+	byAddr := make(map[string][]string)
+	claimed := make(map[string]int32)
+	for _, fileMetaData := range fileMetaDatas {
+		if isTombstone(fileMetaData) || len(fileMetaData.BlockSizeList) != len(fileMetaData.BlockHashList) {
+			continue
+		}
+		for i, hash := range fileMetaData.BlockHashList {
+			size := fileMetaData.BlockSizeList[i]
+			if known, ok := m.quota.blockSizes[hash]; ok {
+				if known != size {
+					m.mtx.RUnlock()
+					return nil, blockSizeMismatch(fileMetaData.Filename, hash, size, known)
+				}
+				continue
+			}
+			if _, ok := claimed[hash]; !ok && len(m.BlockStoreAddrs) > 0 {
+				addr := m.ConsistentHashRing.GetResponsibleServer(hash)
+				byAddr[addr] = append(byAddr[addr], hash)
+			}
+			claimed[hash] = size
+		}
+	}
+	statBlocks := m.quota.statBlocks
+	m.mtx.RUnlock()
+	if len(byAddr) == 0 {
+		return nil, nil
+	}
+	if statBlocks == nil {
+		statBlocks = m.statBlocks
+	}
+
+	found := make(map[string]int32)
+	for addr, hashes := range byAddr {
+		sizes, err := statBlocks(addr, hashes)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "looking up blocks on %s: %v", addr, err)
+		}
+		for _, hash := range hashes {
+			size, ok := sizes[hash]
+			if !ok {
+				return nil, status.Errorf(codes.FailedPrecondition, "block %s is not stored on %s; upload it first", hash, addr)
+			}
+			if size != claimed[hash] {
+				return nil, blockSizeMismatch(filenameOf(fileMetaDatas, hash), hash, claimed[hash], size)
+			}
+			found[hash] = size
+		}
+	}
+	return found, nil
+}
+
+// Remembers the sizes verifyBlockSizes looked up for the blocks that stored
+// files reference. The caller must hold m.mtx.
+func (m *MetaStore) cacheBlockSizes(blockSizes map[string]int32) {
+	for hash, size := range blockSizes {
+		if !m.quota.referenced(hash) {
+			continue
+		}
+		if m.quota.blockSizes == nil {
+			m.quota.blockSizes = map[string]int32{}
+		}
+		m.quota.blockSizes[hash] = size
+	}
+}
+
+// Tells whether a stored file references a block
+func (q *quotaState) referenced(hash string) bool {
+	for _, counters := range q.usage {
+		if counters.blockRefs[hash] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Asks a BlockStore for the sizes of the given blocks
+func (m *MetaStore) statBlocks(addr string, hashes []string) (map[string]int32, error) {
+	client := RPCClient{TLSConfig: m.BlockStoreTLS, Retries: DEFAULT_RETRIES}
+	var blockSizes map[string]int32
+	err := client.StatBlocks(hashes, addr, &blockSizes)
+	return blockSizes, err
+}
+
+func blockSizeMismatch(filename string, hash string, claimed int32, actual int32) error {
+	return status.Errorf(codes.InvalidArgument, "%s lists block %s as %d bytes, but it is %d", filename, hash, claimed, actual)
+}
+
+// Returns the name of the first file referencing a block
+func filenameOf(fileMetaDatas []*FileMetaData, hash string) string {
+	for _, fileMetaData := range fileMetaDatas {
+		for _, blockHash := range fileMetaData.BlockHashList {
+			if blockHash == hash {
+				return fileMetaData.Filename
+			}
+		}
+	}
+	return ""
+}
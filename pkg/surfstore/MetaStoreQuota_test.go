@@ -0,0 +1,212 @@
+package surfstore
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a MetaStore whose single BlockStore holds blocks of the given sizes
+func newQuotaTestMetaStore(stored map[string]int32) *MetaStore {
+	m := NewMetaStore([]string{"blockstore"})
+	m.quota.statBlocks = func(addr string, hashes []string) (map[string]int32, error) {
+		sizes := make(map[string]int32)
+		for _, hash := range hashes {
+			if size, ok := stored[hash]; ok {
+				sizes[hash] = size
+			}
+		}
+		return sizes, nil
+	}
+	return m
+}
+
+func testFile(filename string, version int32, hashes []string, sizes []int32) *FileMetaData {
+	return &FileMetaData{Filename: filename, Version: version, BlockHashList: hashes, BlockSizeList: sizes}
+}
+
+func TestQuotaUsesStoredBlockSizes(t *testing.T) {
+	m := newQuotaTestMetaStore(map[string]int32{"a": 100, "b": 50})
+	m.Quotas["alice"] = &Quota{LogicalBytes: 120}
+	ctx := userContext("alice")
+
+	tests := []struct {
+		name string
+		file *FileMetaData
+		code codes.Code
+	}{
+		{"understated block sizes", testFile("f", 1, []string{"a", "b"}, []int32{0, 0}), codes.InvalidArgument},
+		{"missing block", testFile("f", 1, []string{"c"}, []int32{10}), codes.FailedPrecondition},
+		{"over quota", testFile("f", 1, []string{"a", "b"}, []int32{100, 50}), codes.ResourceExhausted},
+		{"within quota", testFile("f", 1, []string{"a"}, []int32{100}), codes.OK},
+		{"block already checked", testFile("g", 1, []string{"a"}, []int32{1}), codes.InvalidArgument},
+	}
+	for _, test := range tests {
+		_, err := m.UpdateFile(ctx, test.file)
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+		}
+	}
+}
+
+func TestQuotaCounters(t *testing.T) {
+	m := newQuotaTestMetaStore(map[string]int32{"a": 100, "b": 50})
+	ctx := userContext("alice")
+	updates := []*FileMetaData{
+		testFile("f", 1, []string{"a", "b"}, []int32{100, 50}),
+		testFile("g", 1, []string{"a"}, []int32{100}),
+		testFile("f", 2, []string{TOMBSTONE_HASHVALUE}, nil),
+	}
+	want := []struct{ logical, physical int64 }{{150, 150}, {250, 150}, {100, 100}}
+	for i, update := range updates {
+		if _, err := m.UpdateFile(ctx, update); err != nil {
+			t.Fatalf("UpdateFile(%s, version %d): %v", update.Filename, update.Version, err)
+		}
+		usage, err := m.GetQuotaUsage(ctx, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if usage.LogicalBytes != want[i].logical || usage.PhysicalBytes != want[i].physical {
+			t.Errorf("after update %d: usage is %d logical and %d physical bytes, want %d and %d",
+				i, usage.LogicalBytes, usage.PhysicalBytes, want[i].logical, want[i].physical)
+		}
+	}
+}
+
+func TestCommitBatchReportsFilesOverQuota(t *testing.T) {
+	m := newQuotaTestMetaStore(map[string]int32{"a": 100, "b": 50})
+	m.Quotas["alice"] = &Quota{LogicalBytes: 120}
+	if _, err := m.UpdateFile(userContext("alice"), testFile("old", 1, []string{"b"}, []int32{50})); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdateFile(userContext("bob"), testFile("bobs", 1, []string{"a"}, []int32{100})); err != nil {
+		t.Fatal(err)
+	}
+
+	updates := &FileUpdates{FileUpdates: []*FileUpdate{
+		{FileMetaData: testFile("big", 1, []string{"a", "b"}, []int32{100, 50})},
+		{FileMetaData: testFile("old", 2, []string{TOMBSTONE_HASHVALUE}, nil), ExpectedVersion: 1},
+		{FileMetaData: testFile("bobs", 2, []string{"a", "b"}, []int32{100, 50}), ExpectedVersion: 1},
+	}}
+	result, err := m.CommitBatch(userContext("alice"), updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Committed || len(result.OverQuota) != 1 || result.OverQuota["big"] == "" {
+		t.Fatalf("got committed=%v, overQuota=%v, want only big over quota", result.Committed, result.OverQuota)
+	}
+
+	updates.FileUpdates = updates.FileUpdates[1:]
+	if result, err = m.CommitBatch(userContext("alice"), updates); err != nil || !result.Committed {
+		t.Fatalf("committing without big: got %v, %v", result, err)
+	}
+}
+
+func TestCheckBatchLeavesOutLargestFiles(t *testing.T) {
+	m := newQuotaTestMetaStore(nil)
+	m.Quotas["alice"] = &Quota{LogicalBytes: 120}
+	updates := &FileUpdates{FileUpdates: []*FileUpdate{
+		{FileMetaData: testFile("big", 1, []string{"a"}, []int32{100})},
+		{FileMetaData: testFile("small", 1, []string{"b"}, []int32{50})},
+	}}
+	result, err := m.CheckBatch(userContext("alice"), updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Committed || len(result.OverQuota) != 1 || result.OverQuota["big"] == "" {
+		t.Errorf("got committed=%v, overQuota=%v, want only big over quota", result.Committed, result.OverQuota)
+	}
+
+	// Blocks need not be stored yet, and nothing is committed
+	result, err = m.CheckBatch(userContext("alice"), &FileUpdates{FileUpdates: updates.FileUpdates[1:]})
+	if err != nil || !result.Committed {
+		t.Fatalf("checking small: got %v, %v", result, err)
+	}
+	if len(m.FileMetaMap) != 0 {
+		t.Errorf("CheckBatch stored %v", m.FileMetaMap)
+	}
+}
+
+// Updates that would be rejected anyway make the MetaStore ask no BlockStore
+// for block sizes
+func TestRejectedUpdatesLookUpNoBlocks(t *testing.T) {
+	m := newQuotaTestMetaStore(map[string]int32{"a": 100, "h": 1})
+	putTestFile(t, m, "bob", "bobs/f")
+	if _, err := m.ShareFolder(userContext("bob"), &ShareRequest{Folder: "bobs", User: "carol", Permission: Permission_READ}); err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, m, "alice", "f")
+	lookups := 0
+	statBlocks := m.quota.statBlocks
+	m.quota.statBlocks = func(addr string, hashes []string) (map[string]int32, error) {
+		lookups++
+		return statBlocks(addr, hashes)
+	}
+
+	tests := []struct {
+		name   string
+		update func() error
+	}{
+		{"without write permission", func() error {
+			_, err := m.UpdateFile(userContext("alice"), testFile("bobs/g", 1, []string{"a"}, []int32{100}))
+			return err
+		}},
+		{"stale version", func() error {
+			_, err := m.UpdateFile(userContext("alice"), testFile("f", 1, []string{"a"}, []int32{100}))
+			return err
+		}},
+		{"batch without write permission", func() error {
+			_, err := m.CommitBatch(userContext("alice"), &FileUpdates{FileUpdates: []*FileUpdate{
+				{FileMetaData: testFile("bobs/g", 1, []string{"a"}, []int32{100})},
+			}})
+			return err
+		}},
+		{"batch with a stale version", func() error {
+			_, err := m.CommitBatch(userContext("alice"), &FileUpdates{FileUpdates: []*FileUpdate{
+				{FileMetaData: testFile("g", 1, []string{"a"}, []int32{100})},
+				{FileMetaData: testFile("f", 1, []string{"a"}, []int32{100})},
+			}})
+			return err
+		}},
+	}
+	for _, test := range tests {
+		lookups = 0
+		test.update()
+		if lookups != 0 {
+			t.Errorf("%s: looked up blocks %d times, want none", test.name, lookups)
+		}
+	}
+}
+
+// Only the sizes of blocks that stored files reference are remembered
+func TestBlockSizesOfStoredFilesAreCached(t *testing.T) {
+	m := newQuotaTestMetaStore(map[string]int32{"a": 100, "b": 50})
+	m.Quotas["alice"] = &Quota{PhysicalBytes: 120}
+	ctx := userContext("alice")
+
+	steps := []struct {
+		name   string
+		update *FileMetaData
+		cached []string
+	}{
+		{"missing block", testFile("f", 1, []string{"a", "c"}, []int32{100, 10}), []string{}},
+		{"stored file", testFile("f", 1, []string{"a"}, []int32{100}), []string{"a"}},
+		{"second block", testFile("f", 2, []string{"a", "b"}, []int32{100, 50}), []string{"a"}},
+		{"replaced block", testFile("f", 2, []string{"b"}, []int32{50}), []string{"b"}},
+		{"deleted file", testFile("f", 3, []string{TOMBSTONE_HASHVALUE}, nil), []string{}},
+	}
+	for _, step := range steps {
+		m.UpdateFile(ctx, step.update)
+		got := []string{}
+		for hash := range m.quota.blockSizes {
+			got = append(got, hash)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, step.cached) {
+			t.Errorf("after %s: sizes of %v are cached, want %v", step.name, got, step.cached)
+		}
+	}
+}
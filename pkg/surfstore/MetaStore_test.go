@@ -0,0 +1,255 @@
+package surfstore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns the names of the files on each page of a listing and the page
+// tokens that follow them
+func listPages(t *testing.T, m *MetaStore, user string, req *ListFilesRequest) ([][]string, []string) {
+	t.Helper()
+	pages, tokens := [][]string{}, []string{}
+	for {
+		page, err := m.ListFiles(userContext(user), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		filenames := []string{}
+		for _, fileMetaData := range page.Files {
+			filenames = append(filenames, fileMetaData.Filename)
+		}
+		pages = append(pages, filenames)
+		tokens = append(tokens, page.NextPageToken)
+		if page.NextPageToken == "" {
+			return pages, tokens
+		}
+		req.PageToken = page.NextPageToken
+	}
+}
+
+func TestListFilesPaging(t *testing.T) {
+	m := NewMetaStore(nil)
+	for _, filename := range []string{"c", "a/3", "b/1", "a/1", "a/4", "a/2"} {
+		putTestFile(t, m, "alice", filename)
+	}
+	// Files in a folder shared without alice are left out
+	putTestFile(t, m, "bob", "bobs/1")
+	if _, err := m.ShareFolder(userContext("bob"), &ShareRequest{Folder: "bobs", User: "carol", Permission: Permission_READ}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdateFile(userContext("alice"), &FileMetaData{Filename: "a/4", Version: 2, BlockHashList: []string{TOMBSTONE_HASHVALUE}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		req    *ListFilesRequest
+		pages  [][]string
+		tokens []string
+	}{
+		{"all files", &ListFilesRequest{PageSize: 2},
+			[][]string{{"a/1", "a/2"}, {"a/3", "b/1"}, {"c"}}, []string{"a/2", "b/1", ""}},
+		{"prefix", &ListFilesRequest{Prefix: "a/", PageSize: 2},
+			[][]string{{"a/1", "a/2"}, {"a/3"}}, []string{"a/2", ""}},
+		{"deleted files", &ListFilesRequest{Prefix: "a/", PageSize: 2, IncludeDeleted: true},
+			[][]string{{"a/1", "a/2"}, {"a/3", "a/4"}}, []string{"a/2", ""}},
+		{"starting after a token", &ListFilesRequest{PageToken: "a/3", PageSize: 10},
+			[][]string{{"b/1", "c"}}, []string{""}},
+		{"no matches", &ListFilesRequest{Prefix: "d", PageSize: 2},
+			[][]string{{}}, []string{""}},
+	}
+	for _, test := range tests {
+		pages, tokens := listPages(t, m, "alice", test.req)
+		if !reflect.DeepEqual(pages, test.pages) || !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("%s: got pages %v with tokens %q, want %v with %q", test.name, pages, tokens, test.pages, test.tokens)
+		}
+	}
+}
+
+// The page token is a file name rather than an offset, so files created
+// while paging do not make later pages skip or repeat files
+func TestListFilesCursorIsStable(t *testing.T) {
+	m := NewMetaStore(nil)
+	for _, filename := range []string{"b", "d", "f", "h"} {
+		putTestFile(t, m, "alice", filename)
+	}
+	page, err := m.ListFiles(userContext("alice"), &ListFilesRequest{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, m, "alice", "a")
+	putTestFile(t, m, "alice", "e")
+
+	pages, _ := listPages(t, m, "alice", &ListFilesRequest{PageSize: 2, PageToken: page.NextPageToken})
+	if want := [][]string{{"e", "f"}, {"h"}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("after %q got %v, want %v", page.NextPageToken, pages, want)
+	}
+}
+
+func TestListFilesPageSize(t *testing.T) {
+	m := NewMetaStore(nil)
+	for i := 0; i <= int(MAX_PAGE_SIZE); i++ {
+		putTestFile(t, m, "alice", fmt.Sprintf("f%04d", i))
+	}
+	tests := []struct {
+		pageSize int32
+		want     int
+	}{
+		{0, int(DEFAULT_PAGE_SIZE)},
+		{-1, int(DEFAULT_PAGE_SIZE)},
+		{5, 5},
+		{MAX_PAGE_SIZE + 1, int(MAX_PAGE_SIZE)},
+	}
+	for _, test := range tests {
+		page, err := m.ListFiles(userContext("alice"), &ListFilesRequest{PageSize: test.pageSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Files) != test.want || page.NextPageToken != page.Files[len(page.Files)-1].Filename {
+			t.Errorf("page size %d: got %d files with token %q, want %d ending at the token", test.pageSize, len(page.Files), page.NextPageToken, test.want)
+		}
+	}
+}
+
+func TestListFilesBlockHashes(t *testing.T) {
+	m := NewMetaStore(nil)
+	putTestFile(t, m, "alice", "a")
+	putTestFile(t, m, "alice", "gone")
+	if _, err := m.UpdateFile(userContext("alice"), &FileMetaData{Filename: "gone", Version: 2, BlockHashList: []string{TOMBSTONE_HASHVALUE}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, includeBlockHashes := range []bool{false, true} {
+		page, err := m.ListFiles(userContext("alice"), &ListFilesRequest{IncludeBlockHashes: includeBlockHashes, IncludeDeleted: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := map[string][]string{"a": nil, "gone": {TOMBSTONE_HASHVALUE}}
+		if includeBlockHashes {
+			want["a"] = []string{"h"}
+		}
+		for _, fileMetaData := range page.Files {
+			if !reflect.DeepEqual(fileMetaData.BlockHashList, want[fileMetaData.Filename]) {
+				t.Errorf("with block hashes %v: %s has %v, want %v", includeBlockHashes, fileMetaData.Filename, fileMetaData.BlockHashList, want[fileMetaData.Filename])
+			}
+		}
+	}
+	// Listing does not strip the hashes of the stored file
+	if hashes := m.FileMetaMap["a"].BlockHashList; !reflect.DeepEqual(hashes, []string{"h"}) {
+		t.Errorf("stored file has block hashes %v after listing, want [h]", hashes)
+	}
+}
+
+// A batch with one stale file commits none of its files
+func TestCommitBatchWithStaleVersion(t *testing.T) {
+	m := NewMetaStore(nil)
+	putTestFile(t, m, "alice", "a")
+	putTestFile(t, m, "alice", "b")
+	seq := m.Seq
+	updates := &FileUpdates{FileUpdates: []*FileUpdate{
+		{FileMetaData: &FileMetaData{Filename: "a", BlockHashList: []string{"h2"}, BlockSizeList: []int32{1}}, ExpectedVersion: 1},
+		{FileMetaData: &FileMetaData{Filename: "b", BlockHashList: []string{"h2"}, BlockSizeList: []int32{1}}, ExpectedVersion: 0},
+		{FileMetaData: &FileMetaData{Filename: "c", BlockHashList: []string{"h2"}, BlockSizeList: []int32{1}}, ExpectedVersion: 0},
+	}}
+	result, err := m.CommitBatch(userContext("alice"), updates)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Committed || !reflect.DeepEqual(result.Conflicts, []string{"b"}) || result.Versions["b"] != 1 {
+		t.Errorf("got committed %v with conflicts %v and b at version %d, want b conflicting at version 1",
+			result.Committed, result.Conflicts, result.Versions["b"])
+	}
+	for _, filename := range []string{"a", "b"} {
+		if stored := m.FileMetaMap[filename]; stored.Version != 1 || !reflect.DeepEqual(stored.BlockHashList, []string{"h"}) {
+			t.Errorf("%s was changed to %v", filename, stored)
+		}
+	}
+	if _, ok := m.FileMetaMap["c"]; ok || m.Seq != seq || m.VersionConflicts != 1 {
+		t.Errorf("got c stored %v, seq %d and %d version conflicts, want c not stored, seq %d and 1 conflict", ok, m.Seq, m.VersionConflicts, seq)
+	}
+
+	updates.FileUpdates[1].ExpectedVersion = 1
+	if result, err = m.CommitBatch(userContext("alice"), updates); err != nil || !result.Committed {
+		t.Fatalf("committing with b's current version: got %v, %v", result, err)
+	}
+	if want := map[string]int32{"a": 2, "b": 2, "c": 1}; !reflect.DeepEqual(result.Versions, want) {
+		t.Errorf("committed at versions %v, want %v", result.Versions, want)
+	}
+}
+
+// A renamed file keeps its blocks and continues the version history of a
+// file deleted at its new name
+func TestRenameFile(t *testing.T) {
+	m := NewMetaStore(nil)
+	ctx := userContext("alice")
+	putTestFile(t, m, "alice", "a")
+	putTestFile(t, m, "alice", "b")
+	for _, update := range []*FileMetaData{
+		{Filename: "a", Version: 2, BlockHashList: []string{"h1", "h2"}, BlockSizeList: []int32{1, 1}},
+		{Filename: "b", Version: 2, BlockHashList: []string{TOMBSTONE_HASHVALUE}},
+	} {
+		if _, err := m.UpdateFile(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	version, err := m.RenameFile(ctx, &RenameRequest{OldFilename: "a", NewFilename: "b", Version: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version.Version != 3 {
+		t.Errorf("renamed to version %d, want 3", version.Version)
+	}
+	renamed, tombstone := m.FileMetaMap["b"], m.FileMetaMap["a"]
+	if renamed.Version != 3 || renamed.RenamedFrom != "a" || !reflect.DeepEqual(renamed.BlockHashList, []string{"h1", "h2"}) ||
+		!reflect.DeepEqual(renamed.BlockSizeList, []int32{1, 1}) {
+		t.Errorf("renamed file is %v, want a's blocks at version 3", renamed)
+	}
+	if !isTombstone(tombstone) || tombstone.Version != 3 || tombstone.RenamedTo != "b" {
+		t.Errorf("old name has %v, want a tombstone at version 3 pointing to b", tombstone)
+	}
+}
+
+func TestRenameFileRejected(t *testing.T) {
+	m := NewMetaStore(nil)
+	putTestFile(t, m, "alice", "a")
+	putTestFile(t, m, "alice", "live")
+	putTestFile(t, m, "bob", "readonly/x")
+	putTestFile(t, m, "bob", "writable/x")
+	for folder, permission := range map[string]Permission{"readonly": Permission_READ, "writable": Permission_READ_WRITE} {
+		if _, err := m.ShareFolder(userContext("bob"), &ShareRequest{Folder: folder, User: "alice", Permission: permission}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		req     *RenameRequest
+		code    codes.Code
+		version int32
+	}{
+		{"onto a live file", &RenameRequest{OldFilename: "a", NewFilename: "live", Version: 1}, codes.AlreadyExists, 0},
+		{"into a folder shared read-only", &RenameRequest{OldFilename: "a", NewFilename: "readonly/a", Version: 1}, codes.PermissionDenied, 0},
+		{"stale version", &RenameRequest{OldFilename: "a", NewFilename: "b", Version: 2}, codes.OK, -1},
+		{"missing file", &RenameRequest{OldFilename: "missing", NewFilename: "b", Version: 1}, codes.NotFound, 0},
+		{"into a folder shared read-write", &RenameRequest{OldFilename: "a", NewFilename: "writable/a", Version: 1}, codes.OK, 1},
+	}
+	for _, test := range tests {
+		version, err := m.RenameFile(userContext("alice"), test.req)
+		if status.Code(err) != test.code {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.code)
+			continue
+		}
+		if err == nil && version.Version != test.version {
+			t.Errorf("%s: got version %d, want %d", test.name, version.Version, test.version)
+		}
+		if test.version != 1 && isTombstone(m.FileMetaMap["a"]) {
+			t.Fatalf("%s: a was renamed", test.name)
+		}
+	}
+}
@@ -2,6 +2,14 @@ package surfstore
 
 const DEFAULT_META_FILENAME string = "index.db"
 
+// Settings a base directory is synced with, kept beside index.db
+const CLIENT_CONFIG_FILENAME string = ".surfconfig"
+
+// File in the user's config directory holding named client profiles
+const PROFILES_FILENAME string = "profiles.yaml"
+
+const INDEX_SCHEMA_VERSION int = 3
+
 const TOMBSTONE_HASHVALUE string = "0"
 const EMPTYFILE_HASHVALUE string = "-1"
 
@@ -11,3 +19,31 @@ const HASH_LIST_INDEX int = 2
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+// gRPC metadata key carrying the name of the user a client acts on behalf of
+const USER_METADATA_KEY string = "surfstore-user"
+
+// gRPC metadata key carrying the ID shared by all RPCs of one client operation
+const REQUEST_ID_METADATA_KEY string = "surfstore-request-id"
+
+const FOLDER_DELIMITER string = "/"
+
+// Names the servers report their health under in the gRPC health service.
+// The cluster is serving only while all of the MetaStore's BlockStores are.
+// The server as a whole, which generic health checkers ask about, is serving
+// while its MetaStore is.
+const SERVER_HEALTH_SERVICE string = ""
+const METASTORE_HEALTH_SERVICE string = "surfstore.MetaStore"
+const BLOCKSTORE_HEALTH_SERVICE string = "surfstore.BlockStore"
+const CLUSTER_HEALTH_SERVICE string = "surfstore.Cluster"
+
+// Number of files ListFiles returns per page by default and at most
+const DEFAULT_PAGE_SIZE int32 = 100
+const MAX_PAGE_SIZE int32 = 1000
+
+// Patterns of paths the client neither uploads nor downloads
+const IGNORE_FILENAME string = ".surfignore"
+
+// Prefix of the hidden file a download is written to before it replaces the
+// local file, followed by the request ID of the sync and the file's name
+const DOWNLOAD_PREFIX string = ".surfpart-"
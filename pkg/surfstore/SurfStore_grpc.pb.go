@@ -27,6 +27,9 @@ type BlockStoreClient interface {
 	PutBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
 	HasBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
 	GetBlockHashes(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockHashes, error)
+	GetBlockSizes(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockSizes, error)
+	StatBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockSizes, error)
+	GetScrubStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ScrubStatus, error)
 }
 
 type blockStoreClient struct {
@@ -73,6 +76,33 @@ func (c *blockStoreClient) GetBlockHashes(ctx context.Context, in *emptypb.Empty
 	return out, nil
 }
 
+func (c *blockStoreClient) GetBlockSizes(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockSizes, error) {
+	out := new(BlockSizes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetBlockSizes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) StatBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockSizes, error) {
+	out := new(BlockSizes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/StatBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetScrubStatus(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ScrubStatus, error) {
+	out := new(ScrubStatus)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetScrubStatus", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BlockStoreServer is the server API for BlockStore service.
 // All implementations must embed UnimplementedBlockStoreServer
 // for forward compatibility
@@ -81,6 +111,9 @@ type BlockStoreServer interface {
 	PutBlock(context.Context, *Block) (*Success, error)
 	HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
 	GetBlockHashes(context.Context, *emptypb.Empty) (*BlockHashes, error)
+	GetBlockSizes(context.Context, *emptypb.Empty) (*BlockSizes, error)
+	StatBlocks(context.Context, *BlockHashes) (*BlockSizes, error)
+	GetScrubStatus(context.Context, *emptypb.Empty) (*ScrubStatus, error)
 	mustEmbedUnimplementedBlockStoreServer()
 }
 
@@ -100,6 +133,15 @@ func (UnimplementedBlockStoreServer) HasBlocks(context.Context, *BlockHashes) (*
 func (UnimplementedBlockStoreServer) GetBlockHashes(context.Context, *emptypb.Empty) (*BlockHashes, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockHashes not implemented")
 }
+func (UnimplementedBlockStoreServer) GetBlockSizes(context.Context, *emptypb.Empty) (*BlockSizes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockSizes not implemented")
+}
+func (UnimplementedBlockStoreServer) StatBlocks(context.Context, *BlockHashes) (*BlockSizes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method StatBlocks not implemented")
+}
+func (UnimplementedBlockStoreServer) GetScrubStatus(context.Context, *emptypb.Empty) (*ScrubStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetScrubStatus not implemented")
+}
 func (UnimplementedBlockStoreServer) mustEmbedUnimplementedBlockStoreServer() {}
 
 // UnsafeBlockStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -185,6 +227,60 @@ func _BlockStore_GetBlockHashes_Handler(srv interface{}, ctx context.Context, de
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BlockStore_GetBlockSizes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetBlockSizes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetBlockSizes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetBlockSizes(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_StatBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).StatBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/StatBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).StatBlocks(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetScrubStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetScrubStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetScrubStatus",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetScrubStatus(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BlockStore_ServiceDesc is the grpc.ServiceDesc for BlockStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -208,6 +304,18 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockHashes",
 			Handler:    _BlockStore_GetBlockHashes_Handler,
 		},
+		{
+			MethodName: "GetBlockSizes",
+			Handler:    _BlockStore_GetBlockSizes_Handler,
+		},
+		{
+			MethodName: "StatBlocks",
+			Handler:    _BlockStore_StatBlocks_Handler,
+		},
+		{
+			MethodName: "GetScrubStatus",
+			Handler:    _BlockStore_GetScrubStatus_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
@@ -218,9 +326,20 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 // For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
 type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
+	GetChangesSince(ctx context.Context, in *ChangesRequest, opts ...grpc.CallOption) (*FileChanges, error)
+	ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*FilePage, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
+	RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*Version, error)
+	CommitBatch(ctx context.Context, in *FileUpdates, opts ...grpc.CallOption) (*BatchResult, error)
+	CheckBatch(ctx context.Context, in *FileUpdates, opts ...grpc.CallOption) (*BatchResult, error)
 	GetBlockStoreMap(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockStoreMap, error)
 	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	ShareFolder(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*FolderACL, error)
+	UnshareFolder(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*FolderACL, error)
+	GetFolderACLs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FolderACLs, error)
+	GetQuotaUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*QuotaUsage, error)
+	GetClusterHealth(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ClusterHealth, error)
+	GetChunkingParams(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ChunkingParams, error)
 }
 
 type metaStoreClient struct {
@@ -240,6 +359,24 @@ func (c *metaStoreClient) GetFileInfoMap(ctx context.Context, in *emptypb.Empty,
 	return out, nil
 }
 
+func (c *metaStoreClient) GetChangesSince(ctx context.Context, in *ChangesRequest, opts ...grpc.CallOption) (*FileChanges, error) {
+	out := new(FileChanges)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetChangesSince", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*FilePage, error) {
+	out := new(FilePage)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ListFiles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error) {
 	out := new(Version)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UpdateFile", in, out, opts...)
@@ -249,6 +386,33 @@ func (c *metaStoreClient) UpdateFile(ctx context.Context, in *FileMetaData, opts
 	return out, nil
 }
 
+func (c *metaStoreClient) RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RenameFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) CommitBatch(ctx context.Context, in *FileUpdates, opts ...grpc.CallOption) (*BatchResult, error) {
+	out := new(BatchResult)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/CommitBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) CheckBatch(ctx context.Context, in *FileUpdates, opts ...grpc.CallOption) (*BatchResult, error) {
+	out := new(BatchResult)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/CheckBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 func (c *metaStoreClient) GetBlockStoreMap(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockStoreMap, error) {
 	out := new(BlockStoreMap)
 	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreMap", in, out, opts...)
@@ -267,14 +431,79 @@ func (c *metaStoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Em
 	return out, nil
 }
 
+func (c *metaStoreClient) ShareFolder(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*FolderACL, error) {
+	out := new(FolderACL)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/ShareFolder", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) UnshareFolder(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*FolderACL, error) {
+	out := new(FolderACL)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UnshareFolder", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetFolderACLs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FolderACLs, error) {
+	out := new(FolderACLs)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetFolderACLs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetQuotaUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*QuotaUsage, error) {
+	out := new(QuotaUsage)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetQuotaUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetClusterHealth(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ClusterHealth, error) {
+	out := new(ClusterHealth)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetClusterHealth", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetChunkingParams(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ChunkingParams, error) {
+	out := new(ChunkingParams)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetChunkingParams", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
 type MetaStoreServer interface {
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
+	GetChangesSince(context.Context, *ChangesRequest) (*FileChanges, error)
+	ListFiles(context.Context, *ListFilesRequest) (*FilePage, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
+	RenameFile(context.Context, *RenameRequest) (*Version, error)
+	CommitBatch(context.Context, *FileUpdates) (*BatchResult, error)
+	CheckBatch(context.Context, *FileUpdates) (*BatchResult, error)
 	GetBlockStoreMap(context.Context, *BlockHashes) (*BlockStoreMap, error)
 	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	ShareFolder(context.Context, *ShareRequest) (*FolderACL, error)
+	UnshareFolder(context.Context, *ShareRequest) (*FolderACL, error)
+	GetFolderACLs(context.Context, *emptypb.Empty) (*FolderACLs, error)
+	GetQuotaUsage(context.Context, *emptypb.Empty) (*QuotaUsage, error)
+	GetClusterHealth(context.Context, *emptypb.Empty) (*ClusterHealth, error)
+	GetChunkingParams(context.Context, *emptypb.Empty) (*ChunkingParams, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -285,15 +514,48 @@ type UnimplementedMetaStoreServer struct {
 func (UnimplementedMetaStoreServer) GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetFileInfoMap not implemented")
 }
+func (UnimplementedMetaStoreServer) GetChangesSince(context.Context, *ChangesRequest) (*FileChanges, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChangesSince not implemented")
+}
+func (UnimplementedMetaStoreServer) ListFiles(context.Context, *ListFilesRequest) (*FilePage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
+}
 func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (*Version, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method UpdateFile not implemented")
 }
+func (UnimplementedMetaStoreServer) RenameFile(context.Context, *RenameRequest) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
+func (UnimplementedMetaStoreServer) CommitBatch(context.Context, *FileUpdates) (*BatchResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitBatch not implemented")
+}
+func (UnimplementedMetaStoreServer) CheckBatch(context.Context, *FileUpdates) (*BatchResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckBatch not implemented")
+}
 func (UnimplementedMetaStoreServer) GetBlockStoreMap(context.Context, *BlockHashes) (*BlockStoreMap, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreMap not implemented")
 }
 func (UnimplementedMetaStoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
 }
+func (UnimplementedMetaStoreServer) ShareFolder(context.Context, *ShareRequest) (*FolderACL, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ShareFolder not implemented")
+}
+func (UnimplementedMetaStoreServer) UnshareFolder(context.Context, *ShareRequest) (*FolderACL, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnshareFolder not implemented")
+}
+func (UnimplementedMetaStoreServer) GetFolderACLs(context.Context, *emptypb.Empty) (*FolderACLs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFolderACLs not implemented")
+}
+func (UnimplementedMetaStoreServer) GetQuotaUsage(context.Context, *emptypb.Empty) (*QuotaUsage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetQuotaUsage not implemented")
+}
+func (UnimplementedMetaStoreServer) GetClusterHealth(context.Context, *emptypb.Empty) (*ClusterHealth, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetClusterHealth not implemented")
+}
+func (UnimplementedMetaStoreServer) GetChunkingParams(context.Context, *emptypb.Empty) (*ChunkingParams, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetChunkingParams not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -325,6 +587,42 @@ func _MetaStore_GetFileInfoMap_Handler(srv interface{}, ctx context.Context, dec
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_GetChangesSince_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ChangesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetChangesSince",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetChangesSince(ctx, req.(*ChangesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_ListFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFilesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ListFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ListFiles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ListFiles(ctx, req.(*ListFilesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(FileMetaData)
 	if err := dec(in); err != nil {
@@ -343,6 +641,60 @@ func _MetaStore_UpdateFile_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RenameFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RenameFile(ctx, req.(*RenameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_CommitBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileUpdates)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).CommitBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/CommitBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).CommitBatch(ctx, req.(*FileUpdates))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_CheckBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileUpdates)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).CheckBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/CheckBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).CheckBatch(ctx, req.(*FileUpdates))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 func _MetaStore_GetBlockStoreMap_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
 	in := new(BlockHashes)
 	if err := dec(in); err != nil {
@@ -379,6 +731,114 @@ func _MetaStore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_ShareFolder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShareRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).ShareFolder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/ShareFolder",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).ShareFolder(ctx, req.(*ShareRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_UnshareFolder_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShareRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).UnshareFolder(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/UnshareFolder",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).UnshareFolder(ctx, req.(*ShareRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetFolderACLs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetFolderACLs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetFolderACLs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetFolderACLs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetQuotaUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetQuotaUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetQuotaUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetQuotaUsage(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetClusterHealth_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetClusterHealth(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetClusterHealth",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetClusterHealth(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetChunkingParams_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetChunkingParams(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetChunkingParams",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetChunkingParams(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -390,10 +850,30 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetFileInfoMap",
 			Handler:    _MetaStore_GetFileInfoMap_Handler,
 		},
+		{
+			MethodName: "GetChangesSince",
+			Handler:    _MetaStore_GetChangesSince_Handler,
+		},
+		{
+			MethodName: "ListFiles",
+			Handler:    _MetaStore_ListFiles_Handler,
+		},
 		{
 			MethodName: "UpdateFile",
 			Handler:    _MetaStore_UpdateFile_Handler,
 		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _MetaStore_RenameFile_Handler,
+		},
+		{
+			MethodName: "CommitBatch",
+			Handler:    _MetaStore_CommitBatch_Handler,
+		},
+		{
+			MethodName: "CheckBatch",
+			Handler:    _MetaStore_CheckBatch_Handler,
+		},
 		{
 			MethodName: "GetBlockStoreMap",
 			Handler:    _MetaStore_GetBlockStoreMap_Handler,
@@ -402,6 +882,30 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockStoreAddrs",
 			Handler:    _MetaStore_GetBlockStoreAddrs_Handler,
 		},
+		{
+			MethodName: "ShareFolder",
+			Handler:    _MetaStore_ShareFolder_Handler,
+		},
+		{
+			MethodName: "UnshareFolder",
+			Handler:    _MetaStore_UnshareFolder_Handler,
+		},
+		{
+			MethodName: "GetFolderACLs",
+			Handler:    _MetaStore_GetFolderACLs_Handler,
+		},
+		{
+			MethodName: "GetQuotaUsage",
+			Handler:    _MetaStore_GetQuotaUsage_Handler,
+		},
+		{
+			MethodName: "GetClusterHealth",
+			Handler:    _MetaStore_GetClusterHealth_Handler,
+		},
+		{
+			MethodName: "GetChunkingParams",
+			Handler:    _MetaStore_GetChunkingParams_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
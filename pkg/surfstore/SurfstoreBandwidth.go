@@ -0,0 +1,182 @@
+package surfstore
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+	Bandwidth limiting
+
+The client can cap the bytes per second it uploads and downloads blocks at.
+Each direction has a token bucket holding up to a second's worth of bytes;
+a block takes its size in tokens and the transfer waits while the bucket is
+in debt. A schedule changes the limits by time of day, e.g.
+
+	limits:
+	  upload: 1M
+	  download: 4M
+	  schedule:
+	    - {from: "22:00", to: "06:00", upload: 0, download: 0}
+
+The limits are looked up for every block, so a window that opens during a
+sync applies to the rest of it. 0 means unlimited.
+*/
+
+// Bandwidth limits as they are written in .surfconfig and profiles
+type BandwidthConfig struct {
+	Upload   string            `yaml:"upload,omitempty"`
+	Download string            `yaml:"download,omitempty"`
+	Schedule []BandwidthWindow `yaml:"schedule,omitempty"`
+}
+
+// Limits that apply from From until To local time instead, as HH:MM. A window
+// that ends before it starts spans midnight, and one that ends when it starts
+// the whole day. Unset limits are the defaults.
+type BandwidthWindow struct {
+	From     string `yaml:"from"`
+	To       string `yaml:"to"`
+	Upload   string `yaml:"upload,omitempty"`
+	Download string `yaml:"download,omitempty"`
+}
+
+// BandwidthLimiter paces the block transfers of a client. A nil one does not.
+type BandwidthLimiter struct {
+	upload   *tokenBucket
+	download *tokenBucket
+}
+
+// Bytes per second in each direction, 0 meaning unlimited
+type bandwidthRates struct {
+	upload   int64
+	download int64
+}
+
+// Rates from one minute of the day (inclusive) until another (exclusive)
+type bandwidthSpan struct {
+	from  int
+	to    int
+	rates bandwidthRates
+}
+
+// NewBandwidthLimiter parses config, returning nil if it limits nothing
+func NewBandwidthLimiter(config BandwidthConfig) (*BandwidthLimiter, error) {
+	defaults := bandwidthRates{}
+	var err error
+	if defaults.upload, err = parseRate("upload", config.Upload, 0); err != nil {
+		return nil, err
+	}
+	if defaults.download, err = parseRate("download", config.Download, 0); err != nil {
+		return nil, err
+	}
+	spans := []bandwidthSpan{}
+	limited := defaults != bandwidthRates{}
+	for i, window := range config.Schedule {
+		field := fmt.Sprintf("schedule[%d]", i)
+		span := bandwidthSpan{}
+		if span.from, err = parseTimeOfDay(window.From); err != nil {
+			return nil, fmt.Errorf("%s.from: %v", field, err)
+		}
+		if span.to, err = parseTimeOfDay(window.To); err != nil {
+			return nil, fmt.Errorf("%s.to: %v", field, err)
+		}
+		if span.rates.upload, err = parseRate(field+".upload", window.Upload, defaults.upload); err != nil {
+			return nil, err
+		}
+		if span.rates.download, err = parseRate(field+".download", window.Download, defaults.download); err != nil {
+			return nil, err
+		}
+		limited = limited || span.rates != bandwidthRates{}
+		spans = append(spans, span)
+	}
+	if !limited {
+		return nil, nil
+	}
+	ratesAt := func(now time.Time) bandwidthRates {
+		minute := now.Hour()*60 + now.Minute()
+		for _, span := range spans {
+			if span.from < span.to && minute >= span.from && minute < span.to ||
+				span.from >= span.to && (minute >= span.from || minute < span.to) {
+				return span.rates
+			}
+		}
+		return defaults
+	}
+	return &BandwidthLimiter{
+		upload:   &tokenBucket{rate: func(now time.Time) int64 { return ratesAt(now).upload }},
+		download: &tokenBucket{rate: func(now time.Time) int64 { return ratesAt(now).download }},
+	}, nil
+}
+
+// Waits until n more bytes may be uploaded
+func (limiter *BandwidthLimiter) waitUpload(n int) {
+	if limiter != nil {
+		limiter.upload.take(n)
+	}
+}
+
+// Waits until n more downloaded bytes fit the download limit
+func (limiter *BandwidthLimiter) waitDownload(n int) {
+	if limiter != nil {
+		limiter.download.take(n)
+	}
+}
+
+type tokenBucket struct {
+	rate   func(time.Time) int64
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Takes n tokens, sleeping off the debt if there were fewer
+func (b *tokenBucket) take(n int) {
+	b.mtx.Lock()
+	now := time.Now()
+	rate := float64(b.rate(now))
+	if rate <= 0 {
+		b.last = time.Time{}
+		b.mtx.Unlock()
+		return
+	}
+	// A bucket that was unlimited until now starts out full
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = math.Min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(0)
+	if b.tokens < 0 {
+		delay = time.Duration(-b.tokens / rate * float64(time.Second))
+	}
+	b.mtx.Unlock()
+	time.Sleep(delay)
+}
+
+// Parses a limit in bytes per second, returning fallback if it is unset
+func parseRate(field string, value string, fallback int64) (int64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	rate, err := ParseByteSize(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", field, err)
+	}
+	if rate < 0 {
+		return 0, fmt.Errorf("%s: must not be negative", field)
+	}
+	return rate, nil
+}
+
+// Returns the minute of the day of an HH:MM time
+func parseTimeOfDay(value string) (int, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
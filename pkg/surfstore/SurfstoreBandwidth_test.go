@@ -0,0 +1,118 @@
+package surfstore
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBandwidthSchedule(t *testing.T) {
+	limiter, err := NewBandwidthLimiter(BandwidthConfig{
+		Upload:   "1K",
+		Download: "4K",
+		Schedule: []BandwidthWindow{
+			{From: "22:00", To: "06:00", Upload: "0"},
+			{From: "12:00", To: "13:00", Download: "2K"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		clock    string
+		upload   int64
+		download int64
+	}{
+		{"21:59", 1 << 10, 4 << 10},
+		{"22:00", 0, 4 << 10},
+		{"23:59", 0, 4 << 10},
+		{"00:00", 0, 4 << 10},
+		{"05:59", 0, 4 << 10},
+		{"06:00", 1 << 10, 4 << 10},
+		{"12:30", 1 << 10, 2 << 10},
+		{"13:00", 1 << 10, 4 << 10},
+	}
+	for _, test := range tests {
+		now, err := time.Parse("15:04", test.clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if upload, download := limiter.upload.rate(now), limiter.download.rate(now); upload != test.upload || download != test.download {
+			t.Errorf("at %s: got upload %d and download %d, want %d and %d", test.clock, upload, download, test.upload, test.download)
+		}
+	}
+}
+
+// A window that ends when it starts lasts the whole day
+func TestBandwidthWindowAllDay(t *testing.T) {
+	limiter, err := NewBandwidthLimiter(BandwidthConfig{
+		Upload:   "1K",
+		Schedule: []BandwidthWindow{{From: "08:00", To: "08:00", Upload: "2K"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, clock := range []string{"00:00", "07:59", "08:00", "23:59"} {
+		now, _ := time.Parse("15:04", clock)
+		if upload := limiter.upload.rate(now); upload != 2<<10 {
+			t.Errorf("at %s: got upload %d, want %d", clock, upload, 2<<10)
+		}
+	}
+}
+
+func TestBandwidthLimiterUnlimited(t *testing.T) {
+	for _, config := range []BandwidthConfig{
+		{},
+		{Upload: "0", Download: "0"},
+		{Schedule: []BandwidthWindow{{From: "22:00", To: "06:00", Upload: "0"}}},
+	} {
+		if limiter, err := NewBandwidthLimiter(config); limiter != nil || err != nil {
+			t.Errorf("%+v: got %v, %v, want no limiter", config, limiter, err)
+		}
+	}
+}
+
+func TestBandwidthConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config BandwidthConfig
+		want   string
+	}{
+		{"bad upload", BandwidthConfig{Upload: "lots"}, "upload: "},
+		{"negative download", BandwidthConfig{Download: "-1K"}, `download: invalid byte size "-1K"`},
+		{"bad start", BandwidthConfig{Schedule: []BandwidthWindow{{From: "10pm", To: "06:00"}}},
+			`schedule[0].from: expected HH:MM, got "10pm"`},
+		{"bad end", BandwidthConfig{Schedule: []BandwidthWindow{{From: "22:00", To: "24:00"}}},
+			`schedule[0].to: expected HH:MM, got "24:00"`},
+		{"missing end", BandwidthConfig{Schedule: []BandwidthWindow{{From: "22:00"}}},
+			`schedule[0].to: expected HH:MM, got ""`},
+		{"bad window rate", BandwidthConfig{Schedule: []BandwidthWindow{{From: "22:00", To: "06:00"}, {From: "12:00", To: "13:00", Download: "fast"}}},
+			"schedule[1].download: "},
+	}
+	for _, test := range tests {
+		_, err := NewBandwidthLimiter(test.config)
+		if err == nil || !strings.HasPrefix(err.Error(), test.want) {
+			t.Errorf("%s: got error %v, want one starting with %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	rate := int64(0)
+	bucket := &tokenBucket{rate: func(time.Time) int64 { return rate }}
+	start := time.Now()
+	bucket.take(1 << 20)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("unlimited bucket took %v to take a megabyte", elapsed)
+	}
+
+	// The bucket starts out full with a second's worth of tokens, so taking
+	// 1.5 seconds' worth leaves a debt of half a second
+	rate = 10000
+	start = time.Now()
+	bucket.take(5000)
+	bucket.take(10000)
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("taking 15000 tokens at 10000 per second took %v, want about 500ms", elapsed)
+	}
+}
@@ -0,0 +1,276 @@
+package surfstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"gopkg.in/yaml.v3"
+)
+
+/*
+	Client configuration
+
+.surfconfig beside index.db records the settings a base directory is synced
+with, so they need not be repeated on every invocation:
+
+	metaStores: [localhost:8081, localhost:9081]
+	blockSize: 4096
+	recursive: true
+	ignore: ["*.tmp"]
+	user: alice
+	tls: {ca: ca.pem}
+	limits: {upload: 1M}
+
+The first sync of a base directory records the settings that belong to it:
+its MetaStores, block size, whether it is synced recursively and its ignore
+patterns. The others, such as the user or the TLS files, can be added by hand;
+relative file paths in .surfconfig are taken relative to the base directory.
+
+Named profiles in <user config dir>/surfstore/profiles.yaml map a name to the
+same settings. index.db only makes sense for the block size it was built with,
+so a sync with a different one fails unless the client is told to re-chunk or
+the MetaStore's block size changed.
+*/
+
+// Settings of a base directory or profile; unset ones are zero
+type ClientConfig struct {
+	// MetaStores to sync with, tried in order until one is serving
+	MetaStoreAddrs []string `yaml:"metaStores,omitempty"`
+	BlockSize      int      `yaml:"blockSize,omitempty"`
+	// Whether subdirectories of the base directory are synced too
+	Recursive bool `yaml:"recursive,omitempty"`
+	// Patterns in .surfignore syntax, in addition to .surfignore's
+	Ignore []string        `yaml:"ignore,omitempty"`
+	User   string          `yaml:"user,omitempty"`
+	TLS    ClientTLSConfig `yaml:"tls,omitempty"`
+	// Bytes per second blocks are transferred at, see BandwidthConfig
+	Limits BandwidthConfig `yaml:"limits,omitempty"`
+}
+
+type ClientTLSConfig struct {
+	CA   string `yaml:"ca,omitempty"`
+	Cert string `yaml:"cert,omitempty"`
+	Key  string `yaml:"key,omitempty"`
+}
+
+// Merge overrides the settings of config that override sets
+func (config *ClientConfig) Merge(override *ClientConfig) {
+	if len(override.MetaStoreAddrs) > 0 {
+		config.MetaStoreAddrs = override.MetaStoreAddrs
+	}
+	if override.BlockSize != 0 {
+		config.BlockSize = override.BlockSize
+	}
+	if override.Recursive {
+		config.Recursive = true
+	}
+	if len(override.Ignore) > 0 {
+		config.Ignore = override.Ignore
+	}
+	if override.User != "" {
+		config.User = override.User
+	}
+	if override.TLS != (ClientTLSConfig{}) {
+		config.TLS = override.TLS
+	}
+	if override.Limits.Upload != "" {
+		config.Limits.Upload = override.Limits.Upload
+	}
+	if override.Limits.Download != "" {
+		config.Limits.Download = override.Limits.Download
+	}
+	if len(override.Limits.Schedule) > 0 {
+		config.Limits.Schedule = override.Limits.Schedule
+	}
+}
+
+// LoadClientConfig reads baseDir's .surfconfig, returning nil if it has none
+func LoadClientConfig(baseDir string) (*ClientConfig, error) {
+	path := ConcatPath(baseDir, CLIENT_CONFIG_FILENAME)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	config := &ClientConfig{}
+	if err := decodeClientConfig(data, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// RelativeTo returns the settings with their relative file paths taken
+// relative to dir
+func (config *ClientConfig) RelativeTo(dir string) *ClientConfig {
+	resolved := *config
+	for _, file := range []*string{&resolved.TLS.CA, &resolved.TLS.Cert, &resolved.TLS.Key} {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(dir, *file)
+		}
+	}
+	return &resolved
+}
+
+// BaseDirConfig returns the settings of config that belong to a base
+// directory rather than to the user or the invocation
+func (config *ClientConfig) BaseDirConfig() *ClientConfig {
+	return &ClientConfig{
+		MetaStoreAddrs: config.MetaStoreAddrs,
+		BlockSize:      config.BlockSize,
+		Recursive:      config.Recursive,
+		Ignore:         config.Ignore,
+	}
+}
+
+// WriteClientConfig replaces baseDir's .surfconfig with config
+func WriteClientConfig(config *ClientConfig, baseDir string) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	path := ConcatPath(baseDir, CLIENT_CONFIG_FILENAME)
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// ProfilesPath returns the file the named client profiles are read from
+func ProfilesPath() (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "surfstore", PROFILES_FILENAME), nil
+}
+
+// LoadProfile returns the client profile called name
+func LoadProfile(name string) (*ClientConfig, error) {
+	path, err := ProfilesPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	profiles := map[string]*ClientConfig{}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&profiles); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	config, ok := profiles[name]
+	if !ok || config == nil {
+		return nil, fmt.Errorf("%s has no profile %q", path, name)
+	}
+	if err := validateClientConfig(config); err != nil {
+		return nil, fmt.Errorf("%s: profile %s: %v", path, name, err)
+	}
+	return config, nil
+}
+
+// Decodes YAML settings, rejecting unknown ones
+func decodeClientConfig(data []byte, config *ClientConfig) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return err
+	}
+	return validateClientConfig(config)
+}
+
+func validateClientConfig(config *ClientConfig) error {
+	if config.BlockSize < 0 {
+		return fmt.Errorf("blockSize must be positive, not %d", config.BlockSize)
+	}
+	if _, err := NewBandwidthLimiter(config.Limits); err != nil {
+		return fmt.Errorf("limits.%v", err)
+	}
+	return nil
+}
+
+// ChooseMetaStore points the client at the first of addrs that is serving, or
+// at the first one if none are
+func (surfClient *RPCClient) ChooseMetaStore(addrs []string) {
+	if len(addrs) == 0 {
+		return
+	}
+	surfClient.MetaStoreAddr = addrs[0]
+	if len(addrs) == 1 {
+		return
+	}
+	for _, addr := range addrs {
+		var servingStatus grpc_health_v1.HealthCheckResponse_ServingStatus
+		err := surfClient.CheckHealth(addr, METASTORE_HEALTH_SERVICE, &servingStatus)
+		if err == nil && servingStatus == grpc_health_v1.HealthCheckResponse_SERVING {
+			surfClient.MetaStoreAddr = addr
+			return
+		}
+		surfClient.logger().Warn("metastore not serving", "addr", addr, "error", err, "status", servingStatus)
+	}
+}
+
+// UseServerBlockSize switches the client to the block size its MetaStore
+// advertises and reports whether it advertises one
+func (surfClient *RPCClient) UseServerBlockSize() (bool, error) {
+	params := &ChunkingParams{}
+	err := surfClient.GetChunkingParams(params)
+	if status.Code(err) == codes.Unimplemented {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if params.BlockSize == 0 {
+		return false, nil
+	}
+	if int(params.BlockSize) != surfClient.BlockSize {
+		surfClient.logger().Debug("using the metastore's block size", "block_size", params.BlockSize, "requested", surfClient.BlockSize)
+		surfClient.BlockSize = int(params.BlockSize)
+	}
+	return true, nil
+}
+
+// Settles the block size of a sync. The MetaStore's wins over the client's,
+// and the base directory is re-chunked if it was synced with another one.
+// Otherwise the client's has to match the one the base directory was last
+// synced with, unless it re-chunks, in which case every file is rehashed.
+func negotiateBlockSize(client *RPCClient) error {
+	advertised, err := client.UseServerBlockSize()
+	if err != nil {
+		return err
+	}
+	config, err := LoadClientConfig(client.BaseDir)
+	if err != nil || config == nil || config.BlockSize == 0 || config.BlockSize == client.BlockSize {
+		return err
+	}
+	if !client.Rechunk && !advertised {
+		return fmt.Errorf("%s was synced with %d-byte blocks, not %d; re-chunk to split every file anew", client.BaseDir, config.BlockSize, client.BlockSize)
+	}
+	client.logger().Info("re-chunking", "from", config.BlockSize, "to", client.BlockSize)
+	client.FullRescan = true
+	return nil
+}
+
+// Records the block size index.db was built with in .surfconfig
+func recordBlockSize(client RPCClient) error {
+	config, err := LoadClientConfig(client.BaseDir)
+	if err != nil {
+		return err
+	}
+	if config == nil {
+		config = &ClientConfig{}
+	} else if config.BlockSize == client.BlockSize {
+		return nil
+	}
+	config.BlockSize = client.BlockSize
+	return WriteClientConfig(config, client.BaseDir)
+}
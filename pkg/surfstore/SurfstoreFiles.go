@@ -0,0 +1,134 @@
+package surfstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+/*
+	Single File Operations
+
+These work on one remote file at a time, without a base directory or
+index.db, for tools that do not sync a whole directory.
+*/
+
+// StatFile returns the metadata of a remote file, including its block hashes
+func StatFile(client RPCClient, filename string) (*FileMetaData, error) {
+	filename = strings.Trim(filename, "/")
+	var page FilePage
+	req := &ListFilesRequest{Prefix: filename, PageSize: 1, IncludeBlockHashes: true}
+	if err := client.ListFiles(req, &page); err != nil {
+		return nil, err
+	}
+	if len(page.Files) == 0 || page.Files[0].Filename != filename {
+		return nil, fmt.Errorf("%s does not exist", filename)
+	}
+	return page.Files[0], nil
+}
+
+// CatFile writes the contents of a remote file to w
+func CatFile(client RPCClient, fileMetaData *FileMetaData, w io.Writer) error {
+	if fileMetaData.SymlinkTarget != "" {
+		return fmt.Errorf("%s is a symlink to %s", fileMetaData.Filename, fileMetaData.SymlinkTarget)
+	}
+	return fetchBlocks(client, fileMetaData.BlockHashList, w)
+}
+
+// GetFile downloads a remote file to dest, restoring its mode and
+// modification time. Symlinks are recreated as symlinks.
+func GetFile(client RPCClient, fileMetaData *FileMetaData, dest string) error {
+	if fileMetaData.SymlinkTarget != "" {
+		return os.Symlink(fileMetaData.SymlinkTarget, dest)
+	}
+	file, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	if err := fetchBlocks(client, fileMetaData.BlockHashList, file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return restoreFileAttributes(dest, fileMetaData)
+}
+
+// PutFile uploads the local file src as the remote file filename, replacing
+// the current version if there is one
+func PutFile(client RPCClient, src string, filename string) (*FileMetaData, error) {
+	filename = strings.Trim(filename, "/")
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", src)
+	}
+	if _, err := client.UseServerBlockSize(); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	blockHashes, blockSizes, err := hashBlocks(file, client.BlockSize)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := putFileBlocks(client, src, blockHashes); err != nil {
+		return nil, err
+	}
+	fileMetaData := &FileMetaData{
+		Filename:      filename,
+		BlockHashList: blockHashes,
+		BlockSizeList: blockSizes,
+		Size:          info.Size(),
+		Mtime:         info.ModTime().UnixNano(),
+		Mode:          posixModeOf(info.Mode()),
+	}
+	return fileMetaData, commitFile(client, fileMetaData)
+}
+
+// RemoveFile deletes a remote file
+func RemoveFile(client RPCClient, filename string) (*FileMetaData, error) {
+	if _, err := StatFile(client, filename); err != nil {
+		return nil, err
+	}
+	tombstone := &FileMetaData{Filename: strings.Trim(filename, "/"), BlockHashList: []string{TOMBSTONE_HASHVALUE}}
+	return tombstone, commitFile(client, tombstone)
+}
+
+// Commits a file on top of whatever version the server has, setting the
+// version it was committed at
+func commitFile(client RPCClient, fileMetaData *FileMetaData) error {
+	var expectedVersion int32
+	var page FilePage
+	req := &ListFilesRequest{Prefix: fileMetaData.Filename, PageSize: 1, IncludeDeleted: true}
+	if err := client.ListFiles(req, &page); err != nil {
+		return err
+	}
+	if len(page.Files) > 0 && page.Files[0].Filename == fileMetaData.Filename {
+		expectedVersion = page.Files[0].Version
+	}
+
+	var result BatchResult
+	update := &FileUpdate{FileMetaData: fileMetaData, ExpectedVersion: expectedVersion}
+	if err := client.CommitBatch([]*FileUpdate{update}, &result); err != nil {
+		return err
+	}
+	if len(result.Denied) > 0 {
+		return fmt.Errorf("permission denied for %s", fileMetaData.Filename)
+	}
+	if reason, ok := result.OverQuota[fileMetaData.Filename]; ok {
+		return fmt.Errorf("%s: %s", fileMetaData.Filename, reason)
+	}
+	if !result.Committed {
+		return fmt.Errorf("%s was changed by someone else in the meantime", fileMetaData.Filename)
+	}
+	fileMetaData.Version = result.Versions[fileMetaData.Filename]
+	return nil
+}
@@ -2,14 +2,12 @@ package surfstore
 
 import (
 	"crypto/sha256"
-	"database/sql"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
+	"path"
+	"strconv"
 	"strings"
-
-	_ "github.com/mattn/go-sqlite3"
 )
 
 /* Hash Related */
@@ -24,99 +22,78 @@ func GetBlockHashString(blockData []byte) string {
 	return hex.EncodeToString(blockHash)
 }
 
-/* File Path Related */
-func ConcatPath(baseDir, fileDir string) string {
-	return baseDir + "/" + fileDir
+// A tombstone records that a file was deleted
+func isTombstone(fileMetaData *FileMetaData) bool {
+	return len(fileMetaData.BlockHashList) == 1 && fileMetaData.BlockHashList[0] == TOMBSTONE_HASHVALUE
 }
 
-/*
-	Writing Local Metadata File Related
-*/
-
-const createTable string = `create table if not exists indexes (
-		fileName TEXT, 
-		version INT,
-		hashIndex INT,
-		hashValue TEXT
-	);`
-
-// WriteMetaFile writes the file meta map back to local metadata file index.db
-func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
-	// remove index.db file if it exists
-	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
-	if _, err := os.Stat(outputMetaPath); err == nil {
-		e := os.Remove(outputMetaPath)
-		if e != nil {
-			log.Fatal("Error During Meta Write Back")
+// ParseByteSize parses a byte count such as "4096", "512K", "10M" or "2G"
+func ParseByteSize(s string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	digits := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	multiplier := int64(1)
+	if len(digits) > 0 {
+		if unit, ok := units[digits[len(digits)-1]]; ok {
+			multiplier = unit
+			digits = digits[:len(digits)-1]
 		}
 	}
-	db, err := sql.Open("sqlite3", outputMetaPath)
-	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid byte size %q", s)
+	}
+	return n * multiplier, nil
+}
+
+/* File Mode Related */
+
+// posixModeOf converts an os.FileMode to the POSIX mode bits kept in FileMetaData
+func posixModeOf(mode os.FileMode) uint32 {
+	posixMode := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		posixMode |= 04000
 	}
-	statement, err := db.Prepare(createTable)
-	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+	if mode&os.ModeSetgid != 0 {
+		posixMode |= 02000
 	}
-	statement.Exec()
-	index := 0
-	for _, fileMeta := range fileMetas {
-		fileName := fileMeta.Filename
-		version := fileMeta.Version
-		hashIndex := index
-		for _, hashValue := range fileMeta.BlockHashList {
-			_, err = db.Exec(`INSERT INTO indexes (fileName, version, hashIndex, hashValue) VALUES (?, ?, ?, ?)`, fileName, version, hashIndex, hashValue)
-			if err != nil {
-				log.Fatal(err)
-			}
-		}
-		index++
+	if mode&os.ModeSticky != 0 {
+		posixMode |= 01000
 	}
-	db.Close()
-	return nil
+	return posixMode
 }
 
-/*
-Reading Local Metadata File Related
-*/
-
-// LoadMetaFromMetaFile loads the local metadata file into a file meta map.
-// The key is the file's name and the value is the file's metadata.
-// You can use this function to load the index.db file in this project.
-func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
-	fileMetaMap = make(map[string]*FileMetaData)
-	metaFilePath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
-	fs, err := os.Stat(metaFilePath)
-	if err != nil || fs == nil {
-		return fileMetaMap, nil
+// fileModeOf converts POSIX mode bits back to an os.FileMode
+func fileModeOf(posixMode uint32) os.FileMode {
+	mode := os.FileMode(posixMode).Perm()
+	if posixMode&04000 != 0 {
+		mode |= os.ModeSetuid
 	}
-	db, err := sql.Open("sqlite3", metaFilePath)
-	if err != nil {
-		log.Fatal(err)
+	if posixMode&02000 != 0 {
+		mode |= os.ModeSetgid
 	}
-	var filename string
-	var version int
-	var hashIndex int
-	var hashValue string
-	var hashValueSlices []string
-	rows, err := db.Query("SELECT * FROM indexes")
-	if err != nil {
-		log.Fatal(err)
+	if posixMode&01000 != 0 {
+		mode |= os.ModeSticky
 	}
-	for rows.Next() {
-		err := rows.Scan(&filename, &version, &hashIndex, &hashValue)
-		if err != nil {
-			log.Fatal(err)
-		}
-		if _, ok := fileMetaMap[filename]; ok {
-			hashValueSlices = append(hashValueSlices, strings.Split(hashValue, " ")...)
-		} else {
-			hashValueSlices = strings.Split(hashValue, " ")
+	return mode
+}
+
+/* File Path Related */
+// Reports whether a filename names a file inside the base directory: it is
+// relative, has no .. elements and is already in path.Clean form
+func validFilename(filename string) bool {
+	if filename == "" || filename == "." || path.IsAbs(filename) || path.Clean(filename) != filename {
+		return false
+	}
+	for _, element := range strings.Split(filename, "/") {
+		if element == ".." {
+			return false
 		}
-		fileMetaMap[filename] = &FileMetaData{Filename: filename, Version: int32(version), BlockHashList: hashValueSlices}
 	}
-	db.Close()
-	return fileMetaMap, nil
+	return true
+}
+
+func ConcatPath(baseDir, fileDir string) string {
+	return baseDir + "/" + fileDir
 }
 
 /*
@@ -0,0 +1,202 @@
+package surfstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+/*
+	Ignore Patterns
+
+.surfignore in the base directory lists gitignore-style patterns of paths
+that are neither uploaded nor downloaded. Blank lines and lines starting
+with # are skipped, ! re-includes a path, a trailing / only matches
+directories and a pattern containing a / is anchored to the base directory.
+* and ? do not match /, while ** matches across directories. The last
+matching pattern wins, and everything under an ignored directory is ignored.
+*/
+
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// NewIgnoreMatcher parses patterns in the .surfignore syntax
+func NewIgnoreMatcher(patterns []string) (*IgnoreMatcher, error) {
+	matcher := &IgnoreMatcher{}
+	for _, line := range patterns {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern := ignorePattern{}
+		if strings.HasPrefix(line, "!") {
+			pattern.negate = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pattern.dirOnly = true
+			line = strings.TrimRight(line, "/")
+		}
+		expr := globToRegexp(strings.TrimPrefix(line, "/"))
+		if !strings.Contains(line, "/") {
+			expr = "(?:.*/)?" + expr
+		}
+		re, err := regexp.Compile("^" + expr + "$")
+		if err != nil {
+			return nil, fmt.Errorf("bad ignore pattern %q: %v", line, err)
+		}
+		pattern.re = re
+		matcher.patterns = append(matcher.patterns, pattern)
+	}
+	return matcher, nil
+}
+
+// LoadIgnoreMatcher reads baseDir's .surfignore, if any, followed by the
+// extra patterns, which take precedence
+func LoadIgnoreMatcher(baseDir string, extra []string) (*IgnoreMatcher, error) {
+	patterns := []string{}
+	file, err := os.Open(ConcatPath(baseDir, IGNORE_FILENAME))
+	if err == nil {
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			patterns = append(patterns, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return NewIgnoreMatcher(append(patterns, extra...))
+}
+
+// Ignored reports whether a slash-separated path relative to the base
+// directory is ignored, either itself or through one of its parent directories
+func (matcher *IgnoreMatcher) Ignored(name string, isDir bool) bool {
+	parts := strings.Split(name, "/")
+	for i := 1; i < len(parts); i++ {
+		if matcher.matches(strings.Join(parts[:i], "/"), true) {
+			return true
+		}
+	}
+	return matcher.matches(name, isDir)
+}
+
+func (matcher *IgnoreMatcher) matches(name string, isDir bool) bool {
+	ignored := false
+	for _, pattern := range matcher.patterns {
+		if pattern.dirOnly && !isDir {
+			continue
+		}
+		if pattern.re.MatchString(name) {
+			ignored = !pattern.negate
+		}
+	}
+	return ignored
+}
+
+func globToRegexp(glob string) string {
+	var expr strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[' && strings.Contains(glob[i+1:], "]"):
+			end := i + 1 + strings.Index(glob[i+1:], "]")
+			class := glob[i+1 : end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i = end
+		case c == '\\' && i+1 < len(glob):
+			i++
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	return expr.String()
+}
+
+/*
+	Sync Scope
+*/
+
+// The paths a client syncs: everything not ignored, limited to the selected
+// subtrees if any are. Subdirectories are only synced by recursive clients.
+// index.db, .surfconfig and .surfignore always stay local.
+type syncScope struct {
+	ignore    *IgnoreMatcher
+	selected  []string
+	recursive bool
+}
+
+func newSyncScope(client RPCClient) (*syncScope, error) {
+	ignore, err := LoadIgnoreMatcher(client.BaseDir, client.Excludes)
+	if err != nil {
+		return nil, err
+	}
+	scope := &syncScope{ignore: ignore, recursive: client.Recursive}
+	for _, selected := range client.SelectedPaths {
+		if selected = strings.Trim(selected, "/"); selected != "" {
+			scope.selected = append(scope.selected, selected)
+		}
+	}
+	return scope, nil
+}
+
+// Reports whether a file is synced. Names that would resolve outside the base
+// directory never are.
+func (scope *syncScope) includes(filename string) bool {
+	if !validFilename(filename) || filename == DEFAULT_META_FILENAME || filename == CLIENT_CONFIG_FILENAME || filename == IGNORE_FILENAME ||
+		isPartFile(filename) || scope.ignore.Ignored(filename, false) {
+		return false
+	}
+	if !scope.recursive && strings.Contains(filename, "/") {
+		return false
+	}
+	if len(scope.selected) == 0 {
+		return true
+	}
+	for _, selected := range scope.selected {
+		if filename == selected || strings.HasPrefix(filename, selected+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether a directory may hold synced files
+func (scope *syncScope) traverses(dirname string) bool {
+	if !scope.recursive || scope.ignore.Ignored(dirname, true) {
+		return false
+	}
+	if len(scope.selected) == 0 {
+		return true
+	}
+	for _, selected := range scope.selected {
+		if dirname == selected || strings.HasPrefix(dirname, selected+"/") || strings.HasPrefix(selected, dirname+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package surfstore
+
+import "testing"
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob string
+		want string
+	}{
+		{"*.log", `[^/]*\.log`},
+		{"a?c", `a[^/]c`},
+		{"**/build", `(?:.*/)?build`},
+		{"logs/**", `logs/.*`},
+		{"a/**/b", `a/(?:.*/)?b`},
+		{"[abc].txt", `[abc]\.txt`},
+		{"[!abc].txt", `[^abc]\.txt`},
+		{"file[0-9]", `file[0-9]`},
+		{"a[b", `a\[b`},
+		{`\*.txt`, `\*\.txt`},
+		{"a+b(c)", `a\+b\(c\)`},
+	}
+	for _, test := range tests {
+		if got := globToRegexp(test.glob); got != test.want {
+			t.Errorf("globToRegexp(%q) = %q, want %q", test.glob, got, test.want)
+		}
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"extension", []string{"*.log"}, "a.log", false, true},
+		{"extension in a subdirectory", []string{"*.log"}, "dir/a.log", false, true},
+		{"extension not at the end", []string{"*.log"}, "a.log.txt", false, false},
+		{"star stops at slashes", []string{"docs/*.md"}, "docs/sub/a.md", false, false},
+		{"question mark", []string{"a?c"}, "abc", false, true},
+		{"question mark needs a character", []string{"a?c"}, "ac", false, false},
+
+		{"leading slash anchors", []string{"/build"}, "build", true, true},
+		{"leading slash anchors below", []string{"/build"}, "src/build", true, false},
+		{"inner slash anchors", []string{"docs/*.md"}, "docs/a.md", false, true},
+		{"inner slash anchors below", []string{"docs/*.md"}, "x/docs/a.md", false, false},
+		{"no slash matches at any depth", []string{"tmp"}, "a/b/tmp", false, true},
+
+		{"leading double star at the top", []string{"**/tmp"}, "tmp", false, true},
+		{"leading double star at any depth", []string{"**/tmp"}, "a/b/tmp", false, true},
+		{"trailing double star", []string{"logs/**"}, "logs/a/b.txt", false, true},
+		{"trailing double star not the directory", []string{"logs/**"}, "logs", true, false},
+		{"inner double star with no directories", []string{"a/**/b"}, "a/b", false, true},
+		{"inner double star with directories", []string{"a/**/b"}, "a/x/y/b", false, true},
+		{"inner double star elsewhere", []string{"a/**/b"}, "c/a/b", false, false},
+
+		{"class", []string{"file[0-9].txt"}, "file1.txt", false, true},
+		{"class not matching", []string{"file[0-9].txt"}, "filex.txt", false, false},
+		{"negated class", []string{"file[!0-9].txt"}, "filex.txt", false, true},
+		{"negated class not matching", []string{"file[!0-9].txt"}, "file1.txt", false, false},
+		{"unterminated class is literal", []string{"a[b"}, "a[b", false, true},
+
+		{"negation re-includes", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation leaves others ignored", []string{"*.log", "!keep.log"}, "other.log", false, true},
+		{"last matching pattern wins", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"negation cannot re-include under an ignored directory", []string{"build/", "!build/keep.txt"}, "build/keep.txt", false, true},
+
+		{"dir-only pattern matches directories", []string{"build/"}, "build", true, true},
+		{"dir-only pattern skips files", []string{"build/"}, "build", false, false},
+		{"dir-only pattern ignores contents", []string{"build/"}, "build/out.o", false, true},
+		{"dir-only pattern at any depth", []string{"build/"}, "src/build/out.o", false, true},
+
+		{"comments and blank lines are skipped", []string{"# comment", "", "*.tmp  "}, "# comment", false, false},
+		{"trailing spaces are trimmed", []string{"*.tmp  "}, "a.tmp", false, true},
+		{"escaped hash", []string{`\#notes`}, "#notes", false, true},
+	}
+	for _, test := range tests {
+		matcher, err := NewIgnoreMatcher(test.patterns)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := matcher.Ignored(test.path, test.isDir); got != test.want {
+			t.Errorf("%s: Ignored(%q, %v) with %q = %v, want %v", test.name, test.path, test.isDir, test.patterns, got, test.want)
+		}
+	}
+}
+
+func TestIgnoreMatcherRejectsBadPatterns(t *testing.T) {
+	if _, err := NewIgnoreMatcher([]string{"file[z-a]"}); err == nil {
+		t.Error("NewIgnoreMatcher accepted a class with a reversed range")
+	}
+}
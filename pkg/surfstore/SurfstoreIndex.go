@@ -0,0 +1,519 @@
+package surfstore
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+/*
+	Local Metadata File Schema
+
+index.db records its schema version in SQLite's user_version. Every file has
+a row in files and its block hashes in blocks, numbered by ordinal. The
+server's file map as of the last sync is kept the same way in remoteFiles and
+remoteBlocks, together with the sequence number it is current to in
+syncState. syncJournal lists the blocks a sync that has not finished yet
+uploaded. Opening an older index.db upgrades it in place; see
+metaFileMigrations.
+*/
+
+// Tables holding a file meta map
+type indexTables struct {
+	files  string
+	blocks string
+}
+
+var localTables = indexTables{files: "files", blocks: "blocks"}
+var remoteTables = indexTables{files: "remoteFiles", blocks: "remoteBlocks"}
+
+const createFilesTable string = `create table if not exists %s (
+		fileName TEXT PRIMARY KEY,
+		version INT NOT NULL,
+		size INT NOT NULL DEFAULT 0,
+		mtime INT NOT NULL DEFAULT 0,
+		mode INT NOT NULL DEFAULT 0,
+		symlinkTarget TEXT NOT NULL DEFAULT ''
+	);`
+
+const createBlocksTable string = `create table if not exists %s (
+		fileName TEXT NOT NULL,
+		ordinal INT NOT NULL,
+		hashValue TEXT NOT NULL,
+		PRIMARY KEY (fileName, ordinal)
+	);`
+
+const createScanCacheTable string = `create table if not exists scanCache (
+		fileName TEXT PRIMARY KEY,
+		size INT,
+		mtime INT,
+		inode INT
+	);`
+
+const createSyncStateTable string = `create table if not exists syncState (
+		name TEXT PRIMARY KEY,
+		value INT NOT NULL
+	);`
+
+const createSyncJournalTable string = `create table if not exists syncJournal (
+		hashValue TEXT PRIMARY KEY
+	);`
+
+// metaFileMigrations[v] upgrades an index.db from schema version v to v+1
+var metaFileMigrations = []func(tx *sql.Tx) error{
+	migrateUnversionedMetaFile,
+	migrateMetaFileToRemoteIndex,
+	migrateMetaFileToSyncJournal,
+}
+
+// Opens index.db in baseDir, creating it if needed, and upgrades it to the
+// current schema version
+func openMetaFile(baseDir string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", ConcatPath(baseDir, DEFAULT_META_FILENAME))
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateMetaFile(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Fails if index.db exists but would have to be upgraded, without opening
+// it for writing
+func checkMetaFileSchema(baseDir string) error {
+	metaFilePath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
+	if _, err := os.Stat(metaFilePath); err != nil {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", "file:"+metaFilePath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version != INDEX_SCHEMA_VERSION {
+		return fmt.Errorf("%s has schema version %d instead of %d; it is upgraded by the next sync", DEFAULT_META_FILENAME, version, INDEX_SCHEMA_VERSION)
+	}
+	return nil
+}
+
+func migrateMetaFile(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version == INDEX_SCHEMA_VERSION {
+		return nil
+	}
+	if version > INDEX_SCHEMA_VERSION {
+		return fmt.Errorf("%s has schema version %d, newer than the supported %d", DEFAULT_META_FILENAME, version, INDEX_SCHEMA_VERSION)
+	}
+	for ; version < INDEX_SCHEMA_VERSION; version++ {
+		if err := metaFileMigrations[version](tx); err != nil {
+			return fmt.Errorf("migrating %s to schema version %d: %v", DEFAULT_META_FILENAME, version+1, err)
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", INDEX_SCHEMA_VERSION)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Creates the versioned tables and moves over the rows of the unversioned
+// indexes table, which stored one row per block hash with its position only
+// implied by insertion order
+func migrateUnversionedMetaFile(tx *sql.Tx) error {
+	statements := []string{fmt.Sprintf(createFilesTable, localTables.files), fmt.Sprintf(createBlocksTable, localTables.blocks), createScanCacheTable}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	var legacyTables int
+	if err := tx.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'indexes'`).Scan(&legacyTables); err != nil {
+		return err
+	}
+	if legacyTables == 0 {
+		return nil
+	}
+	rows, err := tx.Query("SELECT fileName, version, hashValue, size, mtime, mode, symlinkTarget FROM indexes ORDER BY rowid")
+	if err != nil {
+		// indexes written before file attributes were recorded
+		rows, err = tx.Query("SELECT fileName, version, hashValue, 0, 0, 0, '' FROM indexes ORDER BY rowid")
+	}
+	if err != nil {
+		return err
+	}
+	fileMetas := make(map[string]*FileMetaData)
+	for rows.Next() {
+		var hashValue string
+		fileMeta := &FileMetaData{}
+		if err := rows.Scan(&fileMeta.Filename, &fileMeta.Version, &hashValue, &fileMeta.Size, &fileMeta.Mtime, &fileMeta.Mode, &fileMeta.SymlinkTarget); err != nil {
+			rows.Close()
+			return err
+		}
+		if _, ok := fileMetas[fileMeta.Filename]; !ok {
+			fileMetas[fileMeta.Filename] = fileMeta
+		}
+		if hashValue != EMPTYFILE_HASHVALUE {
+			fileMetas[fileMeta.Filename].BlockHashList = append(fileMetas[fileMeta.Filename].BlockHashList, hashValue)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, fileMeta := range fileMetas {
+		if err := putIndexEntry(tx, localTables, fileMeta); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec("DROP TABLE indexes")
+	return err
+}
+
+// Creates the tables caching the server's file map. The cache starts out
+// empty, so the next sync fetches the full map.
+func migrateMetaFileToRemoteIndex(tx *sql.Tx) error {
+	statements := []string{fmt.Sprintf(createFilesTable, remoteTables.files), fmt.Sprintf(createBlocksTable, remoteTables.blocks), createSyncStateTable}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates the empty sync journal
+func migrateMetaFileToSyncJournal(tx *sql.Tx) error {
+	_, err := tx.Exec(createSyncJournalTable)
+	return err
+}
+
+/*
+	Writing Local Metadata File Related
+*/
+
+// WriteMetaFile writes the file meta map back to local metadata file index.db.
+// Only entries that changed are rewritten, in a single transaction.
+func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
+	db, err := openMetaFile(baseDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := writeIndexEntries(tx, localTables, fileMetas); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Rewrites the entries of tables that differ from fileMetas
+func writeIndexEntries(tx *sql.Tx, tables indexTables, fileMetas map[string]*FileMetaData) error {
+	stored, err := loadIndexEntries(tx, tables)
+	if err != nil {
+		return err
+	}
+	written := make(map[string]bool)
+	for _, fileMeta := range fileMetas {
+		written[fileMeta.Filename] = true
+		if storedMeta, ok := stored[fileMeta.Filename]; ok && sameIndexEntry(storedMeta, fileMeta) {
+			continue
+		}
+		if err := putIndexEntry(tx, tables, fileMeta); err != nil {
+			return err
+		}
+	}
+	for fileName := range stored {
+		if written[fileName] {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM "+tables.files+" WHERE fileName = ?", fileName); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM "+tables.blocks+" WHERE fileName = ?", fileName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the row and block hashes of a file
+func putIndexEntry(tx *sql.Tx, tables indexTables, fileMeta *FileMetaData) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO `+tables.files+` (fileName, version, size, mtime, mode, symlinkTarget) VALUES (?, ?, ?, ?, ?, ?)`,
+		fileMeta.Filename, fileMeta.Version, fileMeta.Size, fileMeta.Mtime, fileMeta.Mode, fileMeta.SymlinkTarget)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM "+tables.blocks+" WHERE fileName = ?", fileMeta.Filename); err != nil {
+		return err
+	}
+	for ordinal, hashValue := range fileMeta.BlockHashList {
+		_, err := tx.Exec(`INSERT INTO `+tables.blocks+` (fileName, ordinal, hashValue) VALUES (?, ?, ?)`, fileMeta.Filename, ordinal, hashValue)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reports whether two entries store the same row and block hashes
+func sameIndexEntry(a *FileMetaData, b *FileMetaData) bool {
+	if a.Version != b.Version || a.Size != b.Size || a.Mtime != b.Mtime || a.Mode != b.Mode || a.SymlinkTarget != b.SymlinkTarget {
+		return false
+	}
+	if len(a.BlockHashList) != len(b.BlockHashList) {
+		return false
+	}
+	for i := range a.BlockHashList {
+		if a.BlockHashList[i] != b.BlockHashList[i] {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Reading Local Metadata File Related
+*/
+
+// LoadMetaFromMetaFile loads the local metadata file into a file meta map.
+// The key is the file's name and the value is the file's metadata.
+// You can use this function to load the index.db file in this project.
+func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
+	metaFilePath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
+	fs, err := os.Stat(metaFilePath)
+	if err != nil || fs == nil {
+		return make(map[string]*FileMetaData), nil
+	}
+	db, err := openMetaFile(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	return loadIndexEntries(tx, localTables)
+}
+
+func loadIndexEntries(tx *sql.Tx, tables indexTables) (map[string]*FileMetaData, error) {
+	fileMetaMap := make(map[string]*FileMetaData)
+	rows, err := tx.Query("SELECT fileName, version, size, mtime, mode, symlinkTarget FROM " + tables.files)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		fileMeta := &FileMetaData{}
+		if err := rows.Scan(&fileMeta.Filename, &fileMeta.Version, &fileMeta.Size, &fileMeta.Mtime, &fileMeta.Mode, &fileMeta.SymlinkTarget); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		fileMetaMap[fileMeta.Filename] = fileMeta
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.Query("SELECT fileName, hashValue FROM " + tables.blocks + " ORDER BY fileName, ordinal")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileName, hashValue string
+		if err := rows.Scan(&fileName, &hashValue); err != nil {
+			return nil, err
+		}
+		if fileMeta, ok := fileMetaMap[fileName]; ok {
+			fileMeta.BlockHashList = append(fileMeta.BlockHashList, hashValue)
+		}
+	}
+	return fileMetaMap, rows.Err()
+}
+
+/*
+	Remote Index Related
+*/
+
+// RemoteIndex is the server's file map as of the last sync, current to
+// sequence number Seq of the MetaStore's epoch Epoch
+type RemoteIndex struct {
+	Epoch       int64
+	Seq         int64
+	FileMetaMap map[string]*FileMetaData
+}
+
+// WriteRemoteIndex replaces the remote index stored in index.db
+func WriteRemoteIndex(remoteIndex *RemoteIndex, baseDir string) error {
+	db, err := openMetaFile(baseDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := writeIndexEntries(tx, remoteTables, remoteIndex.FileMetaMap); err != nil {
+		return err
+	}
+	for name, value := range map[string]int64{"epoch": remoteIndex.Epoch, "seq": remoteIndex.Seq} {
+		if _, err := tx.Exec(`INSERT OR REPLACE INTO syncState (name, value) VALUES (?, ?)`, name, value); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadRemoteIndex loads the remote index from index.db. It is empty, at
+// sequence number 0, if index.db does not exist yet.
+func LoadRemoteIndex(baseDir string) (*RemoteIndex, error) {
+	remoteIndex := &RemoteIndex{FileMetaMap: make(map[string]*FileMetaData)}
+	if _, err := os.Stat(ConcatPath(baseDir, DEFAULT_META_FILENAME)); err != nil {
+		return remoteIndex, nil
+	}
+	db, err := openMetaFile(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query("SELECT name, value FROM syncState")
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name string
+		var value int64
+		if err := rows.Scan(&name, &value); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		switch name {
+		case "epoch":
+			remoteIndex.Epoch = value
+		case "seq":
+			remoteIndex.Seq = value
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if remoteIndex.FileMetaMap, err = loadIndexEntries(tx, remoteTables); err != nil {
+		return nil, err
+	}
+	return remoteIndex, nil
+}
+
+/*
+	Scan Cache Related
+*/
+
+// ScanCacheEntry records what a local file looked like when it was last
+// hashed or written, so an unchanged file does not have to be rehashed
+type ScanCacheEntry struct {
+	Size  int64
+	Mtime int64
+	Inode uint64
+}
+
+// Entries are not trusted for files modified this close to the end of a sync,
+// as a later write within the same mtime tick would go unnoticed
+const scanCacheRacyWindow = 2 * time.Second
+
+func scanCacheEntryOf(info os.FileInfo) *ScanCacheEntry {
+	return &ScanCacheEntry{Size: info.Size(), Mtime: info.ModTime().UnixNano(), Inode: inodeOf(info)}
+}
+
+// WriteScanCache replaces the scan cache stored in index.db
+func WriteScanCache(scanCache map[string]*ScanCacheEntry, baseDir string) error {
+	db, err := openMetaFile(baseDir)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM scanCache"); err != nil {
+		return err
+	}
+	racy := time.Now().Add(-scanCacheRacyWindow).UnixNano()
+	for fileName, entry := range scanCache {
+		if entry.Mtime >= racy {
+			continue
+		}
+		_, err := tx.Exec(`INSERT INTO scanCache (fileName, size, mtime, inode) VALUES (?, ?, ?, ?)`,
+			fileName, entry.Size, entry.Mtime, int64(entry.Inode))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// LoadScanCache loads the scan cache from index.db. It is empty if index.db
+// does not exist yet.
+func LoadScanCache(baseDir string) (map[string]*ScanCacheEntry, error) {
+	scanCache := make(map[string]*ScanCacheEntry)
+	if _, err := os.Stat(ConcatPath(baseDir, DEFAULT_META_FILENAME)); err != nil {
+		return scanCache, nil
+	}
+	db, err := openMetaFile(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	rows, err := db.Query("SELECT fileName, size, mtime, inode FROM scanCache")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var fileName string
+		var inode int64
+		entry := &ScanCacheEntry{}
+		if err := rows.Scan(&fileName, &entry.Size, &entry.Mtime, &inode); err != nil {
+			return nil, err
+		}
+		entry.Inode = uint64(inode)
+		scanCache[fileName] = entry
+	}
+	return scanCache, rows.Err()
+}
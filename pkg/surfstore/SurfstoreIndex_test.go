@@ -0,0 +1,228 @@
+package surfstore
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// Writes an index.db at schema version version: the tables the first version
+// migrations create, filled in by fill
+func writeMetaFileAtVersion(t *testing.T, baseDir string, version int, fill func(tx *sql.Tx) error) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ConcatPath(baseDir, DEFAULT_META_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, migration := range metaFileMigrations[:version] {
+		if err := migration(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fill(tx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version)); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Opens index.db in baseDir, checking it was upgraded to the current schema
+// version with an empty sync journal, and returns its local index
+func loadMigratedMetaFile(t *testing.T, baseDir string) map[string]*FileMetaData {
+	t.Helper()
+	localIndex, err := LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkMetaFileSchema(baseDir); err != nil {
+		t.Error(err)
+	}
+	db, err := openMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var journaled int
+	if err := db.QueryRow("SELECT count(*) FROM syncJournal").Scan(&journaled); err != nil {
+		t.Fatal(err)
+	} else if journaled != 0 {
+		t.Errorf("migrated sync journal has %d blocks, want none", journaled)
+	}
+	return localIndex
+}
+
+func checkIndex(t *testing.T, name string, got map[string]*FileMetaData, want map[string]*FileMetaData) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("%s has %d files, want %d", name, len(got), len(want))
+	}
+	for filename, wantMeta := range want {
+		gotMeta, ok := got[filename]
+		if !ok {
+			t.Errorf("%s is missing %s", name, filename)
+			continue
+		}
+		if gotMeta.Version != wantMeta.Version || !reflect.DeepEqual(gotMeta.BlockHashList, wantMeta.BlockHashList) ||
+			gotMeta.Size != wantMeta.Size || gotMeta.Mtime != wantMeta.Mtime || gotMeta.Mode != wantMeta.Mode || gotMeta.SymlinkTarget != wantMeta.SymlinkTarget {
+			t.Errorf("%s has %v, want %v", name, gotMeta, wantMeta)
+		}
+	}
+}
+
+func checkEmptyRemoteIndex(t *testing.T, baseDir string) {
+	t.Helper()
+	remoteIndex, err := LoadRemoteIndex(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remoteIndex.Epoch != 0 || remoteIndex.Seq != 0 || len(remoteIndex.FileMetaMap) != 0 {
+		t.Errorf("migrated remote index is at epoch %d, seq %d with %d files, want an empty one at 0, 0",
+			remoteIndex.Epoch, remoteIndex.Seq, len(remoteIndex.FileMetaMap))
+	}
+}
+
+func TestMigrateUnversionedMetaFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		create string
+		insert string
+		rows   [][]interface{}
+		want   map[string]*FileMetaData
+	}{
+		{
+			name:   "without file attributes",
+			create: `create table indexes (fileName TEXT, version INT, hashIndex INT, hashValue TEXT)`,
+			insert: `INSERT INTO indexes (fileName, version, hashIndex, hashValue) VALUES (?, ?, ?, ?)`,
+			rows: [][]interface{}{
+				{"a.txt", 2, 0, "h1"},
+				{"a.txt", 2, 0, "h2"},
+				{"a.txt", 2, 0, "h3"},
+				{"empty", 1, 1, EMPTYFILE_HASHVALUE},
+				{"gone", 4, 2, TOMBSTONE_HASHVALUE},
+			},
+			want: map[string]*FileMetaData{
+				"a.txt": {Version: 2, BlockHashList: []string{"h1", "h2", "h3"}},
+				"empty": {Version: 1},
+				"gone":  {Version: 4, BlockHashList: []string{TOMBSTONE_HASHVALUE}},
+			},
+		},
+		{
+			name: "with file attributes",
+			create: `create table indexes (fileName TEXT, version INT, hashIndex INT, hashValue TEXT,
+				size INT, mtime INT, mode INT, symlinkTarget TEXT)`,
+			insert: `INSERT INTO indexes (fileName, version, hashIndex, hashValue, size, mtime, mode, symlinkTarget) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			rows: [][]interface{}{
+				{"b.txt", 1, 0, "h2", 10, 1000, 0644, ""},
+				{"b.txt", 1, 0, "h1", 10, 1000, 0644, ""},
+				{"link", 3, 1, EMPTYFILE_HASHVALUE, 0, 2000, 0777, "b.txt"},
+			},
+			want: map[string]*FileMetaData{
+				"b.txt": {Version: 1, BlockHashList: []string{"h2", "h1"}, Size: 10, Mtime: 1000, Mode: 0644},
+				"link":  {Version: 3, Mtime: 2000, Mode: 0777, SymlinkTarget: "b.txt"},
+			},
+		},
+	}
+	for _, test := range tests {
+		baseDir := t.TempDir()
+		writeMetaFileAtVersion(t, baseDir, 0, func(tx *sql.Tx) error {
+			if _, err := tx.Exec(test.create); err != nil {
+				return err
+			}
+			for _, row := range test.rows {
+				if _, err := tx.Exec(test.insert, row...); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		checkIndex(t, test.name, loadMigratedMetaFile(t, baseDir), test.want)
+		checkEmptyRemoteIndex(t, baseDir)
+		db, err := openMetaFile(baseDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var legacyTables int
+		if err := db.QueryRow(`SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'indexes'`).Scan(&legacyTables); err != nil {
+			t.Fatal(err)
+		} else if legacyTables != 0 {
+			t.Errorf("%s: indexes table was not dropped", test.name)
+		}
+		db.Close()
+	}
+}
+
+// Version 1 has only the local index, which the remote index is added next to
+func TestMigrateMetaFileFromVersion1(t *testing.T) {
+	baseDir := t.TempDir()
+	want := map[string]*FileMetaData{
+		"a.txt": {Filename: "a.txt", Version: 2, BlockHashList: []string{"h1", "h2"}, Size: 8, Mtime: 1000, Mode: 0600},
+		"gone":  {Filename: "gone", Version: 3, BlockHashList: []string{TOMBSTONE_HASHVALUE}},
+	}
+	writeMetaFileAtVersion(t, baseDir, 1, func(tx *sql.Tx) error {
+		return writeIndexEntries(tx, localTables, want)
+	})
+
+	checkIndex(t, "local index", loadMigratedMetaFile(t, baseDir), want)
+	checkEmptyRemoteIndex(t, baseDir)
+}
+
+// Version 2 has the remote index, which is kept, but no sync journal
+func TestMigrateMetaFileFromVersion2(t *testing.T) {
+	baseDir := t.TempDir()
+	local := map[string]*FileMetaData{
+		"a.txt": {Filename: "a.txt", Version: 2, BlockHashList: []string{"h1"}},
+	}
+	remote := map[string]*FileMetaData{
+		"a.txt": {Filename: "a.txt", Version: 2, BlockHashList: []string{"h1"}},
+		"b.txt": {Filename: "b.txt", Version: 5, BlockHashList: []string{"h3", "h4"}, Mode: 0644},
+	}
+	writeMetaFileAtVersion(t, baseDir, 2, func(tx *sql.Tx) error {
+		if err := writeIndexEntries(tx, localTables, local); err != nil {
+			return err
+		}
+		if err := writeIndexEntries(tx, remoteTables, remote); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`INSERT INTO syncState (name, value) VALUES ('epoch', 7), ('seq', 42)`)
+		return err
+	})
+
+	checkIndex(t, "local index", loadMigratedMetaFile(t, baseDir), local)
+	remoteIndex, err := LoadRemoteIndex(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remoteIndex.Epoch != 7 || remoteIndex.Seq != 42 {
+		t.Errorf("remote index is at epoch %d, seq %d, want 7, 42", remoteIndex.Epoch, remoteIndex.Seq)
+	}
+	checkIndex(t, "remote index", remoteIndex.FileMetaMap, remote)
+}
+
+func TestMetaFileNewerThanSupported(t *testing.T) {
+	baseDir := t.TempDir()
+	writeMetaFileAtVersion(t, baseDir, INDEX_SCHEMA_VERSION, func(tx *sql.Tx) error { return nil })
+	db, err := sql.Open("sqlite3", ConcatPath(baseDir, DEFAULT_META_FILENAME))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("PRAGMA user_version = %d", INDEX_SCHEMA_VERSION+1)); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	if _, err := LoadMetaFromMetaFile(baseDir); err == nil {
+		t.Error("loaded an index.db with a newer schema version")
+	}
+}
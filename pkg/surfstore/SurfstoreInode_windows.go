@@ -0,0 +1,9 @@
+package surfstore
+
+import "os"
+
+// inodeOf returns 0 as Windows has no inode numbers; size and mtime still
+// detect changes
+func inodeOf(info os.FileInfo) uint64 {
+	return 0
+}
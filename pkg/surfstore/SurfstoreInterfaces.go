@@ -3,6 +3,7 @@ package surfstore
 import (
 	context "context"
 
+	"google.golang.org/grpc/health/grpc_health_v1"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -10,14 +11,47 @@ type MetaStoreInterface interface {
 	// Retrieves the server's FileInfoMap
 	GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error)
 
+	// Retrieves the FileInfoMap entries changed since a sequence number
+	GetChangesSince(ctx context.Context, req *ChangesRequest) (*FileChanges, error)
+
+	// Retrieves a page of FileInfoMap entries, sorted by name
+	ListFiles(ctx context.Context, req *ListFilesRequest) (*FilePage, error)
+
 	// Update a file's fileinfo entry
 	UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error)
 
+	// Move a file's metadata to a new name
+	RenameFile(ctx context.Context, req *RenameRequest) (*Version, error)
+
+	// Update several files atomically
+	CommitBatch(ctx context.Context, fileUpdates *FileUpdates) (*BatchResult, error)
+
+	// Report what committing several files would do without committing them
+	CheckBatch(ctx context.Context, fileUpdates *FileUpdates) (*BatchResult, error)
+
 	// Retrieve the mapping of BlockStore addresses to block hashes
 	GetBlockStoreMap(ctx context.Context, blockHashesIn *BlockHashes) (*BlockStoreMap, error)
 
 	// Retrieve all BlockStore Addresses
 	GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error)
+
+	// Grant a user access to a shared folder
+	ShareFolder(ctx context.Context, req *ShareRequest) (*FolderACL, error)
+
+	// Revoke a user's access to a shared folder
+	UnshareFolder(ctx context.Context, req *ShareRequest) (*FolderACL, error)
+
+	// Retrieve the shared folders visible to the caller
+	GetFolderACLs(ctx context.Context, _ *emptypb.Empty) (*FolderACLs, error)
+
+	// Retrieve the storage used by the caller's namespace and its quota
+	GetQuotaUsage(ctx context.Context, _ *emptypb.Empty) (*QuotaUsage, error)
+
+	// Retrieve whether the BlockStores are reachable
+	GetClusterHealth(ctx context.Context, _ *emptypb.Empty) (*ClusterHealth, error)
+
+	// Retrieve how clients must split files into blocks
+	GetChunkingParams(ctx context.Context, _ *emptypb.Empty) (*ChunkingParams, error)
 }
 
 type BlockStoreInterface interface {
@@ -34,18 +68,44 @@ type BlockStoreInterface interface {
 
 	// Get which blocks are on this BlockStore server
 	GetBlockHashes(ctx context.Context, _ *emptypb.Empty) (*BlockHashes, error)
+
+	// Get the sizes of the blocks on this BlockStore server
+	GetBlockSizes(ctx context.Context, _ *emptypb.Empty) (*BlockSizes, error)
+
+	// Get the sizes of those of the given blocks that are on this BlockStore server
+	StatBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockSizes, error)
+
+	// Get the progress and findings of the block scrubber
+	GetScrubStatus(ctx context.Context, _ *emptypb.Empty) (*ScrubStatus, error)
 }
 
 type ClientInterface interface {
 	// MetaStore
 	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
+	GetChangesSince(epoch int64, seq int64, fileChanges *FileChanges) error
+	ListFiles(req *ListFilesRequest, filePage *FilePage) error
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
+	RenameFile(oldFilename string, newFilename string, version int32, latestVersion *int32) error
+	CommitBatch(fileUpdates []*FileUpdate, batchResult *BatchResult) error
+	CheckBatch(fileUpdates []*FileUpdate, batchResult *BatchResult) error
 	GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error
 	GetBlockStoreAddrs(blockStoreAddrs *[]string) error
+	ShareFolder(folder string, user string, permission Permission, folderACL *FolderACL) error
+	UnshareFolder(folder string, user string, folderACL *FolderACL) error
+	GetFolderACLs(folderACLs *[]*FolderACL) error
+	GetQuotaUsage(quotaUsage *QuotaUsage) error
+	GetClusterHealth(clusterHealth *ClusterHealth) error
+	GetChunkingParams(chunkingParams *ChunkingParams) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
 	PutBlock(block *Block, blockStoreAddr string, succ *bool) error
 	HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
 	GetBlockHashes(blockStoreAddr string, blockHashes *[]string) error
+	GetBlockSizes(blockStoreAddr string, blockSizes *map[string]int32) error
+	StatBlocks(blockHashesIn []string, blockStoreAddr string, blockSizes *map[string]int32) error
+	GetScrubStatus(blockStoreAddr string, scrubStatus *ScrubStatus) error
+
+	// gRPC health service of either
+	CheckHealth(addr string, service string, servingStatus *grpc_health_v1.HealthCheckResponse_ServingStatus) error
 }
@@ -0,0 +1,179 @@
+package surfstore
+
+import (
+	"database/sql"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+/*
+	Sync journal
+
+A sync writes index.db only once it is done, so one that fails halfway would
+otherwise start over. While it runs, the syncJournal table collects the
+blocks it uploaded, and every file it downloads, commits or renames is
+written to the files table (and the scanCache table for downloads) at once.
+The next sync then skips the blocks its BlockStore still has and finds the
+files it already exchanged up to date. A sync that finishes empties the
+journal.
+
+Downloads are written to a hidden part file named after the request ID of the
+sync, see partFilePath. The part files of a sync that was killed are removed
+when the next one opens the journal.
+*/
+
+// Matches the base name of a part file
+var partFilePattern = regexp.MustCompile("^" + regexp.QuoteMeta(DOWNLOAD_PREFIX) + "[0-9a-f]+-.")
+
+type syncJournal struct {
+	db     *sql.DB
+	blocks map[string]bool
+}
+
+// Opens the journal of baseDir's index.db and loads the blocks an interrupted
+// sync uploaded
+func openSyncJournal(client RPCClient) (*syncJournal, error) {
+	db, err := openMetaFile(client.BaseDir)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT hashValue FROM syncJournal")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	defer rows.Close()
+	journal := &syncJournal{db: db, blocks: make(map[string]bool)}
+	for rows.Next() {
+		var hashValue string
+		if err := rows.Scan(&hashValue); err != nil {
+			db.Close()
+			return nil, err
+		}
+		journal.blocks[hashValue] = true
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if len(journal.blocks) > 0 {
+		client.logger().Info("resuming interrupted sync", "uploaded_blocks", len(journal.blocks))
+	}
+	if err := removePartFiles(client); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return journal, nil
+}
+
+// Returns the part file a download of filepath is written to
+func partFilePath(client RPCClient, filepath string) string {
+	return path.Join(path.Dir(filepath), DOWNLOAD_PREFIX+client.RequestID+"-"+path.Base(filepath))
+}
+
+// Reports whether a file in the base directory is a download's part file
+func isPartFile(filename string) bool {
+	return partFilePattern.MatchString(path.Base(filename))
+}
+
+// Removes the part files that downloads of syncs that were killed left behind
+func removePartFiles(client RPCClient) error {
+	return filepath.WalkDir(client.BaseDir, func(filepath string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() || !isPartFile(entry.Name()) {
+			return err
+		}
+		client.logger().Info("removing part file of an interrupted download", "file", filepath)
+		if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+}
+
+// Reports whether an interrupted sync uploaded a block
+func (journal *syncJournal) has(hashValue string) bool {
+	return journal != nil && journal.blocks[hashValue]
+}
+
+// Records that a block was uploaded
+func (journal *syncJournal) recordBlock(hashValue string) error {
+	if journal == nil || journal.blocks[hashValue] {
+		return nil
+	}
+	if _, err := journal.db.Exec("INSERT OR IGNORE INTO syncJournal (hashValue) VALUES (?)", hashValue); err != nil {
+		return err
+	}
+	journal.blocks[hashValue] = true
+	return nil
+}
+
+// Records the index entry of a file that was just written, along with its
+// scan cache entry, which is nil if the file is gone
+func (journal *syncJournal) recordDownload(fileMeta *FileMetaData, entry *ScanCacheEntry) error {
+	if journal == nil {
+		return nil
+	}
+	tx, err := journal.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := putIndexEntry(tx, localTables, fileMeta); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM scanCache WHERE fileName = ?", fileMeta.Filename); err != nil {
+		return err
+	}
+	if entry != nil && entry.Mtime < time.Now().Add(-scanCacheRacyWindow).UnixNano() {
+		_, err := tx.Exec(`INSERT INTO scanCache (fileName, size, mtime, inode) VALUES (?, ?, ?, ?)`,
+			fileMeta.Filename, entry.Size, entry.Mtime, int64(entry.Inode))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Records the index entries of files the server just committed, so that a
+// sync resuming after this one fails does not find them changed again
+func (journal *syncJournal) recordCommit(fileMetas ...*FileMetaData) error {
+	if journal == nil {
+		return nil
+	}
+	tx, err := journal.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, fileMeta := range fileMetas {
+		if err := putIndexEntry(tx, localTables, fileMeta); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Empties the journal once the sync it belongs to is done
+func (journal *syncJournal) finish() error {
+	if journal == nil {
+		return nil
+	}
+	if _, err := journal.db.Exec("DELETE FROM syncJournal"); err != nil {
+		return err
+	}
+	journal.blocks = make(map[string]bool)
+	return nil
+}
+
+func (journal *syncJournal) close() error {
+	if journal == nil {
+		return nil
+	}
+	return journal.db.Close()
+}
@@ -0,0 +1,69 @@
+package surfstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A sync that was killed after uploading a block, downloading a file and
+// committing another leaves a journal the next sync resumes from
+func TestResumeFromJournal(t *testing.T) {
+	baseDir := t.TempDir()
+	client := RPCClient{BaseDir: baseDir, RequestID: "0123456789abcdef"}
+	journal, err := openSyncJournal(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded := &FileMetaData{Filename: "downloaded", Version: 3, BlockHashList: []string{"a"}}
+	committed := &FileMetaData{Filename: "committed", Version: 2, BlockHashList: []string{"b"}}
+	if err := journal.recordBlock("b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.recordDownload(downloaded, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.recordCommit(committed); err != nil {
+		t.Fatal(err)
+	}
+	journal.close()
+	partFile := filepath.Join(baseDir, partFilePath(client, "big"))
+	userFile := filepath.Join(baseDir, "notes.surfpart")
+	for _, filename := range []string{partFile, userFile} {
+		if err := os.WriteFile(filename, []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client.RequestID = "fedcba9876543210"
+	journal, err = openSyncJournal(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.close()
+	if !journal.has("b") || journal.has("a") {
+		t.Errorf("journal has blocks %v, want only b", journal.blocks)
+	}
+	if _, err := os.Stat(partFile); !os.IsNotExist(err) {
+		t.Errorf("part file of the killed sync was not removed: %v", err)
+	}
+	if _, err := os.Stat(userFile); err != nil {
+		t.Errorf("user file ending in .surfpart: %v", err)
+	}
+	localIndex, err := LoadMetaFromMetaFile(baseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*FileMetaData{downloaded, committed} {
+		if got, ok := localIndex[want.Filename]; !ok || got.Version != want.Version {
+			t.Errorf("index entry of %s is %v, want version %d", want.Filename, got, want.Version)
+		}
+	}
+
+	if err := journal.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if journal.has("b") {
+		t.Error("finished journal still has block b")
+	}
+}
@@ -0,0 +1,182 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Logging
+
+Log lines are written through the standard log package as logfmt key=value
+pairs, e.g.
+
+	level=info msg="rpc finished" request_id=3f2a9c1e5b7d4a60 method=/surfstore.MetaStore/CommitBatch
+
+Every RPC a client makes during one sync carries the same request ID in the
+surfstore-request-id gRPC metadata, so the lines the client, the MetaStore and
+the BlockStores log for that sync can be grepped together.
+*/
+
+type LogLevel int
+
+const (
+	LOG_DEBUG LogLevel = iota
+	LOG_INFO
+	LOG_WARN
+	LOG_ERROR
+	LOG_OFF
+)
+
+var LOG_LEVEL_NAMES = map[LogLevel]string{
+	LOG_DEBUG: "debug",
+	LOG_INFO:  "info",
+	LOG_WARN:  "warn",
+	LOG_ERROR: "error",
+	LOG_OFF:   "off",
+}
+
+func (level LogLevel) String() string {
+	return LOG_LEVEL_NAMES[level]
+}
+
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, levelName := range LOG_LEVEL_NAMES {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LOG_OFF, fmt.Errorf("unknown log level %q, expected debug, info, warn, error or off", name)
+}
+
+// Lines below this level are dropped
+var logLevel = LOG_OFF
+
+// SetLogLevel sets the lowest level that is logged. Turning logging off also
+// silences the standard log package, as the -d flag did before levels.
+func SetLogLevel(level LogLevel) {
+	logLevel = level
+	if level == LOG_OFF {
+		log.SetFlags(0)
+		log.SetOutput(ioutil.Discard)
+	} else {
+		log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+		log.SetOutput(os.Stderr)
+	}
+}
+
+// Returns the level named by a -log-level flag, or debug if it is unset and -d is
+func LogLevelFromFlags(debug bool, levelName string) (LogLevel, error) {
+	if levelName != "" {
+		return ParseLogLevel(levelName)
+	}
+	if debug {
+		return LOG_DEBUG, nil
+	}
+	return LOG_OFF, nil
+}
+
+// Logger writes leveled lines that all carry the same key=value fields
+type Logger struct {
+	fields []interface{}
+}
+
+// With returns a logger that adds the given alternating keys and values to every line
+func (l Logger) With(keyValues ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyValues))
+	fields = append(fields, l.fields...)
+	return Logger{fields: append(fields, keyValues...)}
+}
+
+func (l Logger) Debug(msg string, keyValues ...interface{}) { l.output(LOG_DEBUG, msg, keyValues) }
+func (l Logger) Info(msg string, keyValues ...interface{})  { l.output(LOG_INFO, msg, keyValues) }
+func (l Logger) Warn(msg string, keyValues ...interface{})  { l.output(LOG_WARN, msg, keyValues) }
+func (l Logger) Error(msg string, keyValues ...interface{}) { l.output(LOG_ERROR, msg, keyValues) }
+
+func (l Logger) output(level LogLevel, msg string, keyValues []interface{}) {
+	if level < logLevel {
+		return
+	}
+	var line strings.Builder
+	line.WriteString("level=" + level.String() + " msg=" + logfmtValue(msg))
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+	for i := 0; i < len(fields); i += 2 {
+		line.WriteString(" " + fmt.Sprint(fields[i]) + "=")
+		if i+1 < len(fields) {
+			line.WriteString(logfmtValue(fields[i+1]))
+		}
+	}
+	log.Output(3, line.String())
+}
+
+// Quotes values that contain spaces, quotes or equals signs
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// Returns a random ID that ties together the RPCs of one client operation
+func NewRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+func requestIDFromContext(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if ids := md.Get(REQUEST_ID_METADATA_KEY); len(ids) > 0 {
+		return ids[0]
+	}
+	return ""
+}
+
+type loggerKey struct{}
+
+// Returns the logger of the RPC being handled, which carries its request ID
+func loggerFromContext(ctx context.Context) Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(Logger); ok {
+		return logger
+	}
+	return Logger{}
+}
+
+// LoggingUnaryServerInterceptor gives each RPC a logger carrying its request
+// ID, generating one if the client sent none, and logs how the RPC finished
+func LoggingUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := requestIDFromContext(ctx)
+	if requestID == "" {
+		requestID = NewRequestID()
+	}
+	logger := Logger{}.With("request_id", requestID, "method", info.FullMethod)
+	if user := userFromContext(ctx); user != "" {
+		logger = logger.With("user", user)
+	}
+	start := time.Now()
+	resp, err := handler(context.WithValue(ctx, loggerKey{}, logger), req)
+	if err != nil {
+		logger.Warn("rpc failed", "code", status.Code(err), "error", status.Convert(err).Message(), "duration", time.Since(start))
+	} else {
+		logger.Debug("rpc finished", "duration", time.Since(start))
+	}
+	return resp, err
+}
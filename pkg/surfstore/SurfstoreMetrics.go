@@ -0,0 +1,228 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Metrics
+
+Metrics records the latency and errors of every RPC a server handles and
+exports them, together with the state of its MetaStore and BlockStore, in the
+Prometheus text exposition format.
+*/
+
+// Upper bounds in seconds of the RPC latency histogram buckets
+var RPC_LATENCY_BUCKETS = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type Metrics struct {
+	MetaStore  *MetaStore
+	BlockStore *BlockStore
+	rpcs       map[string]*rpcMetrics
+	mtx        sync.Mutex
+}
+
+// Latency histogram and error counts of one RPC method
+type rpcMetrics struct {
+	service     string
+	method      string
+	bucketCount []int64
+	count       int64
+	sum         float64
+	errors      map[string]int64
+}
+
+// Either store may be nil if the server does not run it
+func NewMetrics(metaStore *MetaStore, blockStore *BlockStore) *Metrics {
+	return &Metrics{
+		MetaStore:  metaStore,
+		BlockStore: blockStore,
+		rpcs:       map[string]*rpcMetrics{},
+	}
+}
+
+// UnaryServerInterceptor records the latency and status code of each RPC
+func (mt *Metrics) UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	mt.observe(info.FullMethod, time.Since(start), err)
+	return resp, err
+}
+
+func (mt *Metrics) observe(fullMethod string, elapsed time.Duration, err error) {
+	mt.mtx.Lock()
+	defer mt.mtx.Unlock()
+	rpc, ok := mt.rpcs[fullMethod]
+	if !ok {
+		service, method := splitFullMethod(fullMethod)
+		rpc = &rpcMetrics{
+			service:     service,
+			method:      method,
+			bucketCount: make([]int64, len(RPC_LATENCY_BUCKETS)),
+			errors:      map[string]int64{},
+		}
+		mt.rpcs[fullMethod] = rpc
+	}
+	seconds := elapsed.Seconds()
+	for i, bound := range RPC_LATENCY_BUCKETS {
+		if seconds <= bound {
+			rpc.bucketCount[i]++
+		}
+	}
+	rpc.count++
+	rpc.sum += seconds
+	if err != nil {
+		rpc.errors[status.Code(err).String()]++
+	}
+}
+
+// Splits /surfstore.MetaStore/UpdateFile into its service and method
+func splitFullMethod(fullMethod string) (string, string) {
+	method := strings.TrimPrefix(fullMethod, "/")
+	if i := strings.LastIndex(method, "/"); i >= 0 {
+		return method[:i], method[i+1:]
+	}
+	return "", method
+}
+
+// ServeHTTP writes all metrics in the Prometheus text format
+func (mt *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mt.WriteMetrics(w)
+}
+
+func (mt *Metrics) WriteMetrics(w io.Writer) {
+	mt.writeRPCMetrics(w)
+	if mt.MetaStore != nil {
+		mt.MetaStore.writeMetrics(w)
+	}
+	if mt.BlockStore != nil {
+		mt.BlockStore.writeMetrics(w)
+	}
+}
+
+func (mt *Metrics) writeRPCMetrics(w io.Writer) {
+	mt.mtx.Lock()
+	defer mt.mtx.Unlock()
+	fullMethods := []string{}
+	for fullMethod := range mt.rpcs {
+		fullMethods = append(fullMethods, fullMethod)
+	}
+	sort.Strings(fullMethods)
+
+	writeMetricHeader(w, "surfstore_rpc_duration_seconds", "histogram", "Latency of handled RPCs.")
+	for _, fullMethod := range fullMethods {
+		rpc := mt.rpcs[fullMethod]
+		labels := []string{"service", rpc.service, "method", rpc.method}
+		for i, bound := range RPC_LATENCY_BUCKETS {
+			writeSample(w, "surfstore_rpc_duration_seconds_bucket", float64(rpc.bucketCount[i]),
+				append(labels, "le", formatFloat(bound))...)
+		}
+		writeSample(w, "surfstore_rpc_duration_seconds_bucket", float64(rpc.count), append(labels, "le", "+Inf")...)
+		writeSample(w, "surfstore_rpc_duration_seconds_sum", rpc.sum, labels...)
+		writeSample(w, "surfstore_rpc_duration_seconds_count", float64(rpc.count), labels...)
+	}
+
+	writeMetricHeader(w, "surfstore_rpc_errors_total", "counter", "RPCs that returned an error, by status code.")
+	for _, fullMethod := range fullMethods {
+		rpc := mt.rpcs[fullMethod]
+		codes := []string{}
+		for code := range rpc.errors {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			writeSample(w, "surfstore_rpc_errors_total", float64(rpc.errors[code]),
+				"service", rpc.service, "method", rpc.method, "code", code)
+		}
+	}
+}
+
+func (m *MetaStore) writeMetrics(w io.Writer) {
+	m.mtx.RLock()
+	defer m.mtx.RUnlock()
+	files, deleted := 0, 0
+	for _, fileMetaData := range m.FileMetaMap {
+		if isTombstone(fileMetaData) {
+			deleted++
+		} else {
+			files++
+		}
+	}
+	writeMetricHeader(w, "surfstore_files", "gauge", "Files in the MetaStore, excluding deleted ones.")
+	writeSample(w, "surfstore_files", float64(files))
+	writeMetricHeader(w, "surfstore_deleted_files", "gauge", "Tombstones of deleted files in the MetaStore.")
+	writeSample(w, "surfstore_deleted_files", float64(deleted))
+	writeMetricHeader(w, "surfstore_version_conflicts_total", "counter", "File updates rejected because the file changed since the expected version.")
+	writeSample(w, "surfstore_version_conflicts_total", float64(m.VersionConflicts))
+
+	points := map[string]int{}
+	for _, addr := range m.ConsistentHashRing.ServerMap {
+		points[addr]++
+	}
+	addrs := []string{}
+	for addr := range points {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	writeMetricHeader(w, "surfstore_ring_members", "gauge", "BlockStores on the consistent hash ring.")
+	writeSample(w, "surfstore_ring_members", float64(len(addrs)))
+	writeMetricHeader(w, "surfstore_ring_member", "gauge", "Always 1, for each BlockStore on the consistent hash ring.")
+	for _, addr := range addrs {
+		writeSample(w, "surfstore_ring_member", 1, "addr", addr, "hash", m.ConsistentHashRing.Hash("blockstore"+addr))
+	}
+	writeMetricHeader(w, "surfstore_ring_member_points", "gauge", "Points each BlockStore has on the consistent hash ring, i.e. its weight.")
+	for _, addr := range addrs {
+		writeSample(w, "surfstore_ring_member_points", float64(points[addr]), "addr", addr)
+	}
+	writeMetricHeader(w, "surfstore_block_size_bytes", "gauge", "Block size clients must split files into, 0 if they choose.")
+	writeSample(w, "surfstore_block_size_bytes", float64(m.BlockSize))
+}
+
+func (bs *BlockStore) writeMetrics(w io.Writer) {
+	bs.mtx.RLock()
+	defer bs.mtx.RUnlock()
+	bytes := int64(0)
+	for _, block := range bs.BlockMap {
+		bytes += int64(block.BlockSize)
+	}
+	writeMetricHeader(w, "surfstore_blocks", "gauge", "Blocks stored in the BlockStore.")
+	writeSample(w, "surfstore_blocks", float64(len(bs.BlockMap)))
+	writeMetricHeader(w, "surfstore_block_bytes", "gauge", "Bytes of block data stored in the BlockStore.")
+	writeSample(w, "surfstore_block_bytes", float64(bytes))
+	writeMetricHeader(w, "surfstore_quarantined_blocks", "gauge", "Corrupt blocks the scrubber quarantined.")
+	writeSample(w, "surfstore_quarantined_blocks", float64(len(bs.Quarantine)))
+}
+
+func writeMetricHeader(w io.Writer, name string, metricType string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Writes one sample; labels alternate between names and values
+func writeSample(w io.Writer, name string, value float64, labels ...string) {
+	pairs := []string{}
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], labelValueEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) > 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, formatFloat(value))
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
@@ -0,0 +1,225 @@
+package surfstore
+
+import (
+	"fmt"
+	"sort"
+)
+
+// SyncPlan is what ClientSync would do, as worked out by PlanSync
+type SyncPlan struct {
+	Uploads         []PlannedFile                   `json:"uploads"`
+	RemoteDeletions []string                        `json:"remoteDeletions"`
+	LocalRenames    []PlannedRename                 `json:"localRenames"`
+	Downloads       []PlannedFile                   `json:"downloads"`
+	LocalDeletions  []string                        `json:"localDeletions"`
+	RemoteRenames   []PlannedRename                 `json:"remoteRenames"`
+	Conflicts       []string                        `json:"conflicts"`
+	BlockServers    map[string]*BlockServerTransfer `json:"blockServers"`
+}
+
+type PlannedFile struct {
+	Filename string `json:"filename"`
+	Version  int32  `json:"version"`
+	Size     int64  `json:"size"`
+}
+
+// Bytes of blocks that would be sent to and fetched from a block server
+type BlockServerTransfer struct {
+	UploadBytes   int64 `json:"uploadBytes"`
+	DownloadBytes int64 `json:"downloadBytes"`
+}
+
+// PlanSync works out what ClientSync would do without writing anything
+// locally or to the server. Uploads that turn out to conflict with changes
+// committed in the meantime cannot be foreseen.
+func PlanSync(client RPCClient) (*SyncPlan, error) {
+	if err := checkMetaFileSchema(client.BaseDir); err != nil {
+		return nil, err
+	}
+	if err := negotiateBlockSize(&client); err != nil {
+		return nil, err
+	}
+	state, err := prepareSync(client)
+	if err != nil {
+		return nil, err
+	}
+	localIndex, remoteIndex, scope := state.localIndex, state.remote.FileMetaMap, state.scope
+	plan := &SyncPlan{
+		Uploads:         []PlannedFile{},
+		RemoteDeletions: []string{},
+		LocalRenames:    matchLocalRenames(localIndex, remoteIndex, state.created, state.deleted),
+		Downloads:       []PlannedFile{},
+		LocalDeletions:  []string{},
+		RemoteRenames:   matchRemoteRenames(localIndex, remoteIndex, scope),
+		Conflicts:       []string{},
+		BlockServers:    make(map[string]*BlockServerTransfer),
+	}
+	renamed := make(map[string]bool)
+	for _, rename := range append(plan.LocalRenames, plan.RemoteRenames...) {
+		renamed[rename.From] = true
+		renamed[rename.To] = true
+	}
+
+	uploadBlocks := make(map[string][]int32)
+	for _, filename := range sortedFilenames(localIndex) {
+		local := localIndex[filename]
+		if renamed[filename] || !scope.includes(filename) || !needsUpload(local, remoteIndex) {
+			continue
+		}
+		if isTombstone(local) {
+			plan.RemoteDeletions = append(plan.RemoteDeletions, filename)
+			continue
+		}
+		plan.Uploads = append(plan.Uploads, PlannedFile{Filename: filename, Version: local.Version, Size: local.Size})
+		if local.SymlinkTarget == "" {
+			uploadBlocks[filename] = local.BlockSizeList
+		}
+	}
+
+	downloadBlocks := make(map[string][]int32)
+	for _, filename := range sortedFilenames(remoteIndex) {
+		remote := remoteIndex[filename]
+		local := localIndex[filename]
+		if renamed[filename] || !scope.includes(filename) || !needsDownload(local, remote) {
+			continue
+		}
+		if state.changed[filename] && !needsUpload(local, remoteIndex) {
+			plan.Conflicts = append(plan.Conflicts, filename)
+		}
+		if isTombstone(remote) {
+			if local != nil && !isTombstone(local) {
+				plan.LocalDeletions = append(plan.LocalDeletions, filename)
+			}
+			continue
+		}
+		plan.Downloads = append(plan.Downloads, PlannedFile{Filename: filename, Version: remote.Version, Size: remote.Size})
+		if remote.SymlinkTarget == "" {
+			blockSizes := remote.BlockSizeList
+			if len(blockSizes) != len(remote.BlockHashList) {
+				blockSizes = blockSizesOf(remote.Size, client.BlockSize)
+			}
+			downloadBlocks[filename] = blockSizes
+		}
+	}
+
+	uploads, err := bytesPerBlockServer(client, localIndex, uploadBlocks)
+	if err != nil {
+		return nil, err
+	}
+	downloads, err := bytesPerBlockServer(client, remoteIndex, downloadBlocks)
+	if err != nil {
+		return nil, err
+	}
+	for addr, bytes := range uploads {
+		plan.transferTo(addr).UploadBytes = bytes
+	}
+	for addr, bytes := range downloads {
+		plan.transferTo(addr).DownloadBytes = bytes
+	}
+	return plan, nil
+}
+
+func (plan *SyncPlan) transferTo(addr string) *BlockServerTransfer {
+	if _, ok := plan.BlockServers[addr]; !ok {
+		plan.BlockServers[addr] = &BlockServerTransfer{}
+	}
+	return plan.BlockServers[addr]
+}
+
+// Adds up the sizes of the given files' blocks by the block server each
+// block is stored on. Every block is counted, as it is sent or fetched even
+// if another file has it too.
+func bytesPerBlockServer(client RPCClient, fileMetas map[string]*FileMetaData, blockSizes map[string][]int32) (map[string]int64, error) {
+	bytes := make(map[string]int64)
+	hashes := []string{}
+	for filename := range blockSizes {
+		hashes = append(hashes, fileMetas[filename].BlockHashList...)
+	}
+	if len(hashes) == 0 {
+		return bytes, nil
+	}
+	var blockStoreMap map[string][]string
+	if err := client.GetBlockStoreMap(hashes, &blockStoreMap); err != nil {
+		return nil, err
+	}
+	hashToAddr := make(map[string]string)
+	for addr, addrHashes := range blockStoreMap {
+		for _, hash := range addrHashes {
+			hashToAddr[hash] = addr
+		}
+	}
+	for filename, sizes := range blockSizes {
+		for i, hash := range fileMetas[filename].BlockHashList {
+			if i < len(sizes) {
+				bytes[hashToAddr[hash]] += int64(sizes[i])
+			}
+		}
+	}
+	return bytes, nil
+}
+
+func sortedFilenames(fileMetas map[string]*FileMetaData) []string {
+	filenames := make([]string, 0, len(fileMetas))
+	for filename := range fileMetas {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// PrintSyncPlan prints a plan for people to read
+func PrintSyncPlan(plan *SyncPlan) {
+	printPlannedFiles("Uploads", "+", plan.Uploads)
+	printFilenames("Remote deletions", "-", plan.RemoteDeletions)
+	printPlannedRenames("Renames on the server", plan.LocalRenames)
+	printPlannedFiles("Downloads", "+", plan.Downloads)
+	printFilenames("Local deletions", "-", plan.LocalDeletions)
+	printPlannedRenames("Local moves", plan.RemoteRenames)
+	printFilenames("Conflicts (local changes replaced by the server's version)", "!", plan.Conflicts)
+
+	addrs := []string{}
+	for addr := range plan.BlockServers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	if len(addrs) > 0 {
+		fmt.Println("Block transfers:")
+	}
+	for _, addr := range addrs {
+		transfer := plan.BlockServers[addr]
+		fmt.Printf("\t%s\tup %d bytes\tdown %d bytes\n", addr, transfer.UploadBytes, transfer.DownloadBytes)
+	}
+	if len(plan.Uploads)+len(plan.RemoteDeletions)+len(plan.LocalRenames)+len(plan.Downloads)+len(plan.LocalDeletions)+len(plan.RemoteRenames) == 0 {
+		fmt.Println("Nothing to sync")
+	}
+}
+
+func printPlannedFiles(title string, marker string, files []PlannedFile) {
+	if len(files) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", title, len(files))
+	for _, file := range files {
+		fmt.Printf("\t%s %s (version %d, %d bytes)\n", marker, file.Filename, file.Version, file.Size)
+	}
+}
+
+func printFilenames(title string, marker string, filenames []string) {
+	if len(filenames) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", title, len(filenames))
+	for _, filename := range filenames {
+		fmt.Printf("\t%s %s\n", marker, filename)
+	}
+}
+
+func printPlannedRenames(title string, renames []PlannedRename) {
+	if len(renames) == 0 {
+		return
+	}
+	fmt.Printf("%s (%d):\n", title, len(renames))
+	for _, rename := range renames {
+		fmt.Printf("\t%s -> %s\n", rename.From, rename.To)
+	}
+}
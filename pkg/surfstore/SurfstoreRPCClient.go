@@ -2,9 +2,14 @@ package surfstore
 
 import (
 	context "context"
+	"crypto/tls"
 	"time"
 
+	"go.opentelemetry.io/otel/trace"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -12,20 +17,36 @@ type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+	User          string
+	FullRescan    bool
+	Rechunk       bool
+	Recursive     bool
+	Excludes      []string
+	SelectedPaths []string
+	RequestID     string
+	TLSConfig     *tls.Config
+	Bandwidth     *BandwidthLimiter
+	Retries       int
+	journal       *syncJournal
+	spanContext   trace.SpanContext
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
+	var b *Block
+	err = surfClient.retry("GetBlock", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		b, err = c.GetBlock(surfClient.withMetadata(ctx), &BlockHash{Hash: blockHash})
+		return err
+	})
 	if err != nil {
 		conn.Close()
 		return err
@@ -38,14 +59,18 @@ func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, b
 }
 
 func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	success, err := c.PutBlock(ctx, block)
+	var success *Success
+	err = surfClient.retry("PutBlock", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		success, err = c.PutBlock(surfClient.withMetadata(ctx), block)
+		return err
+	})
 	if err != nil {
 		conn.Close()
 		return err
@@ -55,14 +80,18 @@ func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ
 }
 
 func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-	defer cancel()
-	b, err := c.HasBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
+	var b *BlockHashes
+	err = surfClient.retry("HasBlocks", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		b, err = c.HasBlocks(surfClient.withMetadata(ctx), &BlockHashes{Hashes: blockHashesIn})
+		return err
+	})
 	if err != nil {
 		conn.Close()
 		return err
@@ -72,30 +101,77 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr st
 }
 
 func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	var file *FileInfoMap
+	err = surfClient.retry("GetFileInfoMap", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		file, err = c.GetFileInfoMap(surfClient.withMetadata(ctx), &emptypb.Empty{})
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*serverFileInfoMap = file.FileInfoMap
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetChangesSince(epoch int64, seq int64, fileChanges *FileChanges) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	var changes *FileChanges
+	err = surfClient.retry("GetChangesSince", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		changes, err = c.GetChangesSince(surfClient.withMetadata(ctx), &ChangesRequest{Epoch: epoch, Seq: seq})
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	fileChanges.Epoch = changes.Epoch
+	fileChanges.Seq = changes.Seq
+	fileChanges.Full = changes.Full
+	fileChanges.FileInfoMap = changes.FileInfoMap
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) ListFiles(req *ListFilesRequest, filePage *FilePage) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewMetaStoreClient(conn)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	file, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
+	page, err := c.ListFiles(surfClient.withMetadata(ctx), req)
 	if err != nil {
+		conn.Close()
 		return err
 	}
-	*serverFileInfoMap = file.FileInfoMap
+	filePage.Files = page.Files
+	filePage.NextPageToken = page.NextPageToken
 	return conn.Close()
 }
 
 func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewMetaStoreClient(conn)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	version, err := c.UpdateFile(ctx, fileMetaData)
+	version, err := c.UpdateFile(surfClient.withMetadata(ctx), fileMetaData)
 	if err != nil {
 		conn.Close()
 		return err
@@ -104,15 +180,78 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
 	return conn.Close()
 }
 
+func (surfClient *RPCClient) RenameFile(oldFilename string, newFilename string, version int32, latestVersion *int32) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	v, err := c.RenameFile(surfClient.withMetadata(ctx), &RenameRequest{OldFilename: oldFilename, NewFilename: newFilename, Version: version})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*latestVersion = v.Version
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) CommitBatch(fileUpdates []*FileUpdate, batchResult *BatchResult) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	result, err := c.CommitBatch(surfClient.withMetadata(ctx), &FileUpdates{FileUpdates: fileUpdates})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	batchResult.Committed = result.Committed
+	batchResult.Versions = result.Versions
+	batchResult.Conflicts = result.Conflicts
+	batchResult.Denied = result.Denied
+	batchResult.OverQuota = result.OverQuota
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) CheckBatch(fileUpdates []*FileUpdate, batchResult *BatchResult) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	var result *BatchResult
+	err = surfClient.retry("CheckBatch", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		result, err = c.CheckBatch(surfClient.withMetadata(ctx), &FileUpdates{FileUpdates: fileUpdates})
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	batchResult.Committed = result.Committed
+	batchResult.Versions = result.Versions
+	batchResult.Conflicts = result.Conflicts
+	batchResult.Denied = result.Denied
+	batchResult.OverQuota = result.OverQuota
+	return conn.Close()
+}
+
 func (surfClient *RPCClient) GetBlockHashes(blockStoreAddr string, blockHashes *[]string) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	bh, err := c.GetBlockHashes(ctx, &emptypb.Empty{})
+	bh, err := c.GetBlockHashes(surfClient.withMetadata(ctx), &emptypb.Empty{})
 	if err != nil {
 		return err
 	}
@@ -121,16 +260,77 @@ func (surfClient *RPCClient) GetBlockHashes(blockStoreAddr string, blockHashes *
 
 }
 
-func (surfClient *RPCClient) GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+func (surfClient *RPCClient) GetBlockSizes(blockStoreAddr string, blockSizes *map[string]int32) error {
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
-	c := NewMetaStoreClient(conn)
+	c := NewBlockStoreClient(conn)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	b, err := c.GetBlockStoreMap(ctx, &BlockHashes{Hashes: blockHashesIn})
+	bs, err := c.GetBlockSizes(surfClient.withMetadata(ctx), &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*blockSizes = bs.BlockSizes
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) StatBlocks(blockHashesIn []string, blockStoreAddr string, blockSizes *map[string]int32) error {
+	conn, err := surfClient.dial(blockStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewBlockStoreClient(conn)
+	var bs *BlockSizes
+	err = surfClient.retry("StatBlocks", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		bs, err = c.StatBlocks(surfClient.withMetadata(ctx), &BlockHashes{Hashes: blockHashesIn})
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*blockSizes = bs.BlockSizes
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetScrubStatus(blockStoreAddr string, scrubStatus *ScrubStatus) error {
+	conn, err := surfClient.dial(blockStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewBlockStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	status, err := c.GetScrubStatus(surfClient.withMetadata(ctx), &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Reset(scrubStatus)
+	proto.Merge(scrubStatus, status)
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetBlockStoreMap(blockHashesIn []string, blockStoreMap *map[string][]string) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	var b *BlockStoreMap
+	err = surfClient.retry("GetBlockStoreMap", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		b, err = c.GetBlockStoreMap(surfClient.withMetadata(ctx), &BlockHashes{Hashes: blockHashesIn})
+		return err
+	})
 	if err != nil {
+		conn.Close()
 		return err
 	}
 	bsm := b.BlockStoreMap
@@ -143,14 +343,14 @@ func (surfClient *RPCClient) GetBlockStoreMap(blockHashesIn []string, blockStore
 }
 
 func (surfClient *RPCClient) GetBlockStoreAddrs(blockStoreAddrs *[]string) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewMetaStoreClient(conn)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	b, err := c.GetBlockStoreAddrs(ctx, &emptypb.Empty{})
+	b, err := c.GetBlockStoreAddrs(surfClient.withMetadata(ctx), &emptypb.Empty{})
 	if err != nil {
 		return err
 	}
@@ -158,6 +358,168 @@ func (surfClient *RPCClient) GetBlockStoreAddrs(blockStoreAddrs *[]string) error
 	return conn.Close()
 }
 
+func (surfClient *RPCClient) ShareFolder(folder string, user string, permission Permission, folderACL *FolderACL) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	acl, err := c.ShareFolder(surfClient.withMetadata(ctx), &ShareRequest{Folder: folder, User: user, Permission: permission})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	folderACL.Folder = acl.Folder
+	folderACL.Owner = acl.Owner
+	folderACL.Grants = acl.Grants
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) UnshareFolder(folder string, user string, folderACL *FolderACL) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	acl, err := c.UnshareFolder(surfClient.withMetadata(ctx), &ShareRequest{Folder: folder, User: user})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	folderACL.Folder = acl.Folder
+	folderACL.Owner = acl.Owner
+	folderACL.Grants = acl.Grants
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetFolderACLs(folderACLs *[]*FolderACL) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	acls, err := c.GetFolderACLs(surfClient.withMetadata(ctx), &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*folderACLs = acls.FolderACLs
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetQuotaUsage(quotaUsage *QuotaUsage) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	usage, err := c.GetQuotaUsage(surfClient.withMetadata(ctx), &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	quotaUsage.Namespace = usage.Namespace
+	quotaUsage.LogicalBytes = usage.LogicalBytes
+	quotaUsage.PhysicalBytes = usage.PhysicalBytes
+	quotaUsage.Limit = usage.Limit
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetClusterHealth(clusterHealth *ClusterHealth) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	// The MetaStore may probe its BlockStores before answering
+	ctx, cancel := context.WithTimeout(context.Background(), 2*HEALTH_PROBE_TIMEOUT)
+	defer cancel()
+	health, err := c.GetClusterHealth(surfClient.withMetadata(ctx), &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Reset(clusterHealth)
+	proto.Merge(clusterHealth, health)
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetChunkingParams(chunkingParams *ChunkingParams) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+	var params *ChunkingParams
+	err = surfClient.retry("GetChunkingParams", func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		params, err = c.GetChunkingParams(surfClient.withMetadata(ctx), &emptypb.Empty{})
+		return err
+	})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	proto.Reset(chunkingParams)
+	proto.Merge(chunkingParams, params)
+	return conn.Close()
+}
+
+// Asks the gRPC health service at addr whether service is serving
+func (surfClient *RPCClient) CheckHealth(addr string, service string, servingStatus *grpc_health_v1.HealthCheckResponse_ServingStatus) error {
+	conn, err := surfClient.dial(addr)
+	if err != nil {
+		return err
+	}
+	c := grpc_health_v1.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := c.Check(surfClient.withMetadata(ctx), &grpc_health_v1.HealthCheckRequest{Service: service})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*servingStatus = resp.Status
+	return conn.Close()
+}
+
+// Connect to a MetaStore or BlockStore, over TLS if the client has a TLS config
+func (surfClient *RPCClient) dial(addr string) (*grpc.ClientConn, error) {
+	return grpc.Dial(addr, transportOption(surfClient.TLSConfig), grpc.WithUnaryInterceptor(tracingUnaryClientInterceptor))
+}
+
+// Attach the user the client acts on behalf of, the request ID and the span the
+// request belongs to to an outgoing request
+func (surfClient *RPCClient) withMetadata(ctx context.Context) context.Context {
+	if surfClient.spanContext.IsValid() {
+		ctx = trace.ContextWithSpanContext(ctx, surfClient.spanContext)
+	}
+	if surfClient.User != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, USER_METADATA_KEY, surfClient.User)
+	}
+	if surfClient.RequestID != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, REQUEST_ID_METADATA_KEY, surfClient.RequestID)
+	}
+	return ctx
+}
+
+// Returns a logger whose lines carry the client's request ID
+func (surfClient *RPCClient) logger() Logger {
+	if surfClient.RequestID == "" {
+		return Logger{}
+	}
+	return Logger{}.With("request_id", surfClient.RequestID)
+}
+
 // This line guarantees all method for RPCClient are implemented
 var _ ClientInterface = new(RPCClient)
 
@@ -168,5 +530,6 @@ func NewSurfstoreRPCClient(hostPort, baseDir string, blockSize int) RPCClient {
 		MetaStoreAddr: hostPort,
 		BaseDir:       baseDir,
 		BlockSize:     blockSize,
+		Retries:       DEFAULT_RETRIES,
 	}
 }
@@ -0,0 +1,155 @@
+package surfstore
+
+import (
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// A file moved from one name to another
+type PlannedRename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Turns a file deleted and an identical file created since the last sync into
+// a single RenameFile instead of a tombstone and a new upload. Renamed files
+// are recorded in remoteIndex as the server stores them. The server keeps the
+// mode and mtime of the old file, so a renamed file whose attributes changed
+// too is left one version ahead to commit them; its blocks are on the server
+// already. Returns those files.
+func syncLocalRenames(client RPCClient, localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData,
+	created []string, deleted map[string]*FileMetaData) map[string]bool {
+	recommit := make(map[string]bool)
+	for _, rename := range matchLocalRenames(localIndex, remoteIndex, created, deleted) {
+		local := localIndex[rename.To]
+		old := deleted[rename.From]
+		var version int32
+		if err := client.RenameFile(rename.From, rename.To, old.Version, &version); err != nil || version == -1 {
+			client.logger().Warn("rename failed, uploading instead", "from", rename.From, "to", rename.To, "error", err)
+			continue
+		}
+		renamed := proto.Clone(old).(*FileMetaData)
+		renamed.Filename = rename.To
+		renamed.Version = version
+		renamed.RenamedFrom = rename.From
+		remoteIndex[rename.To] = renamed
+
+		local.Version = version
+		if local.Mode != old.Mode || local.Mtime != old.Mtime {
+			// Keeps RenamedFrom so other clients still move their copy
+			local.Version++
+			local.RenamedFrom = rename.From
+			recommit[rename.To] = true
+		}
+		localIndex[rename.From].Version = old.Version + 1
+		localIndex[rename.From].RenamedTo = rename.To
+		remoteIndex[rename.From] = proto.Clone(localIndex[rename.From]).(*FileMetaData)
+		if err := client.journal.recordCommit(renamed, localIndex[rename.From]); err != nil {
+			client.logger().Warn("could not journal rename", "from", rename.From, "to", rename.To, "error", err)
+		}
+	}
+	return recommit
+}
+
+// Pairs files deleted since the last sync with created files of the same
+// content. A deleted file is only paired if the server still has it as it
+// was last synced.
+func matchLocalRenames(localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData,
+	created []string, deleted map[string]*FileMetaData) []PlannedRename {
+	candidates := make(map[string][]string)
+	for filename, previous := range deleted {
+		remote, ok := remoteIndex[filename]
+		if !ok || remote.Version != previous.Version || !reflect.DeepEqual(remote.BlockHashList, previous.BlockHashList) {
+			continue
+		}
+		// Empty files and symlinks have no content to recognize them by
+		if len(previous.BlockHashList) == 0 || previous.SymlinkTarget != "" {
+			continue
+		}
+		key := strings.Join(previous.BlockHashList, HASH_DELIMITER)
+		candidates[key] = append(candidates[key], filename)
+	}
+	for _, oldFilenames := range candidates {
+		sort.Strings(oldFilenames)
+	}
+
+	renames := []PlannedRename{}
+	for _, filename := range created {
+		local := localIndex[filename]
+		if remote, ok := remoteIndex[filename]; ok && !isTombstone(remote) {
+			continue
+		}
+		key := strings.Join(local.BlockHashList, HASH_DELIMITER)
+		if len(local.BlockHashList) == 0 || len(candidates[key]) == 0 {
+			continue
+		}
+		renames = append(renames, PlannedRename{From: candidates[key][0], To: filename})
+		candidates[key] = candidates[key][1:]
+	}
+	return renames
+}
+
+// Applies renames made by other clients by moving the local file rather than
+// deleting it and downloading it again under its new name.
+func applyRemoteRenames(client RPCClient, localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData,
+	scanCache map[string]*ScanCacheEntry, scope *syncScope) {
+	for _, rename := range matchRemoteRenames(localIndex, remoteIndex, scope) {
+		remote, oldRemote := remoteIndex[rename.To], remoteIndex[rename.From]
+		oldPath := ConcatPath(client.BaseDir, rename.From)
+		newPath := ConcatPath(client.BaseDir, rename.To)
+		if err := os.MkdirAll(path.Dir(newPath), 0755); err != nil {
+			client.logger().Warn("could not move file, downloading instead", "from", oldPath, "to", newPath, "error", err)
+			continue
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			client.logger().Warn("could not move file, downloading instead", "from", oldPath, "to", newPath, "error", err)
+			continue
+		}
+		if err := restoreFileAttributes(newPath, remote); err != nil {
+			client.logger().Warn("could not restore file attributes", "file", newPath, "error", err)
+		}
+		localIndex[rename.To] = proto.Clone(remote).(*FileMetaData)
+		localIndex[rename.From] = proto.Clone(oldRemote).(*FileMetaData)
+		delete(scanCache, rename.From)
+		if info, err := os.Lstat(newPath); err == nil {
+			scanCache[rename.To] = scanCacheEntryOf(info)
+		}
+		if err := client.journal.recordDownload(localIndex[rename.From], nil); err != nil {
+			client.logger().Warn("could not journal rename", "from", rename.From, "to", rename.To, "error", err)
+		}
+		if err := client.journal.recordDownload(localIndex[rename.To], scanCache[rename.To]); err != nil {
+			client.logger().Warn("could not journal rename", "from", rename.From, "to", rename.To, "error", err)
+		}
+	}
+}
+
+// Finds the renames made by other clients that can be applied locally: the
+// local file is the unmodified version that was renamed, nothing is in the
+// way at the new name, and both names are within the sync scope.
+func matchRemoteRenames(localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData, scope *syncScope) []PlannedRename {
+	renames := []PlannedRename{}
+	for filename, remote := range remoteIndex {
+		if remote.RenamedFrom == "" || !scope.includes(filename) || !scope.includes(remote.RenamedFrom) {
+			continue
+		}
+		oldRemote, ok := remoteIndex[remote.RenamedFrom]
+		if !ok || oldRemote.RenamedTo != filename {
+			continue
+		}
+		old, ok := localIndex[remote.RenamedFrom]
+		if !ok || isTombstone(old) || old.Version != oldRemote.Version-1 || !reflect.DeepEqual(old.BlockHashList, remote.BlockHashList) {
+			continue
+		}
+		if local, ok := localIndex[filename]; ok && !isTombstone(local) {
+			continue
+		}
+		renames = append(renames, PlannedRename{From: remote.RenamedFrom, To: filename})
+	}
+	sort.Slice(renames, func(i, j int) bool { return renames[i].To < renames[j].To })
+	return renames
+}
@@ -0,0 +1,56 @@
+package surfstore
+
+import (
+	"math/rand"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Retries
+
+RPCs that are safe to repeat are retried when the server is unavailable or
+does not answer in time. The nth retry waits a random time of up to
+RETRY_BASE_DELAY * 2^(n-1), capped at RETRY_MAX_DELAY, so clients that lost
+the same server do not all come back at once.
+*/
+
+// Retries of an idempotent RPC after its first attempt
+const DEFAULT_RETRIES int = 4
+
+const RETRY_BASE_DELAY = 100 * time.Millisecond
+const RETRY_MAX_DELAY = 5 * time.Second
+
+// Calls call until it succeeds, fails with an error not worth retrying or has
+// been retried surfClient.Retries times
+func (surfClient *RPCClient) retry(method string, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := call()
+		if err == nil || !retryable(err) || attempt >= surfClient.Retries {
+			return err
+		}
+		delay := backoff(attempt)
+		surfClient.logger().Warn("retrying rpc", "method", method, "attempt", attempt+1, "delay", delay, "error", err)
+		time.Sleep(delay)
+	}
+}
+
+// Reports whether an RPC failed in a way that may pass
+func retryable(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return true
+	}
+	return false
+}
+
+// Returns a random delay before retry attempt+1
+func backoff(attempt int) time.Duration {
+	ceiling := RETRY_MAX_DELAY
+	if attempt < 16 && RETRY_BASE_DELAY<<uint(attempt) < RETRY_MAX_DELAY {
+		ceiling = RETRY_BASE_DELAY << uint(attempt)
+	}
+	return time.Duration(rand.Int63n(int64(ceiling)) + 1)
+}
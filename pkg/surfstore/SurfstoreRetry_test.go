@@ -0,0 +1,70 @@
+package surfstore
+
+import (
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{status.Error(codes.Unavailable, "connection refused"), true},
+		{status.Error(codes.DeadlineExceeded, "timed out"), true},
+		{status.Error(codes.PermissionDenied, "denied"), false},
+		{status.Error(codes.NotFound, "no such block"), false},
+		{status.Error(codes.InvalidArgument, "bad file name"), false},
+		{status.Error(codes.ResourceExhausted, "quota exceeded"), false},
+		{errors.New("not a status"), false},
+	}
+	for _, test := range tests {
+		if got := retryable(test.err); got != test.want {
+			t.Errorf("retryable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+	denied := status.Error(codes.PermissionDenied, "denied")
+	tests := []struct {
+		name     string
+		retries  int
+		errs     []error
+		attempts int
+		code     codes.Code
+	}{
+		{"succeeds at once", 2, []error{nil}, 1, codes.OK},
+		{"succeeds after retrying", 2, []error{unavailable, unavailable, nil}, 3, codes.OK},
+		{"gives up after the retries", 2, []error{unavailable, unavailable, unavailable, nil}, 3, codes.Unavailable},
+		{"does not retry other errors", 2, []error{denied, nil}, 1, codes.PermissionDenied},
+		{"no retries", 0, []error{unavailable, nil}, 1, codes.Unavailable},
+	}
+	for _, test := range tests {
+		client := &RPCClient{Retries: test.retries}
+		attempts := 0
+		err := client.retry("Test", func() error {
+			attempts++
+			return test.errs[attempts-1]
+		})
+		if attempts != test.attempts || status.Code(err) != test.code {
+			t.Errorf("%s: %d attempts ending in %v, want %d ending in %v", test.name, attempts, err, test.attempts, test.code)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 64; attempt++ {
+		ceiling := RETRY_MAX_DELAY
+		if attempt < 6 {
+			ceiling = RETRY_BASE_DELAY << uint(attempt)
+		}
+		if delay := backoff(attempt); delay <= 0 || delay > ceiling {
+			t.Errorf("backoff(%d) = %v, want up to %v", attempt, delay, ceiling)
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package surfstore
+
+import (
+	context "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+/*
+	Tracing
+
+With tracing enabled the client records an OpenTelemetry span for a sync and
+each of its phases, and one for every RPC it makes. The W3C trace context of
+the RPC spans is sent in the gRPC metadata, so the span a MetaStore or
+BlockStore records for handling an RPC joins the client's trace. Spans are
+exported as JSON lines to stdout or stderr, or to an OTLP/HTTP collector by
+the OpenTelemetry OTLP exporter.
+*/
+
+// Name of the instrumentation library the spans are recorded by
+const TRACER_NAME string = "cse224/proj4/surfstore"
+
+var tracer = otel.Tracer(TRACER_NAME)
+
+// InitTracing sends the spans of this process to exporter, which is stdout,
+// stderr or the URL of an OTLP/HTTP collector such as http://localhost:4318.
+// An empty exporter leaves tracing off. The returned function flushes the
+// spans not yet exported and must be called before exiting.
+func InitTracing(exporter string, serviceName string) (func(context.Context) error, error) {
+	if exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var spanExporter sdktrace.SpanExporter
+	switch {
+	case exporter == "stdout":
+		spanExporter = &jsonSpanExporter{w: os.Stdout}
+	case exporter == "stderr":
+		spanExporter = &jsonSpanExporter{w: os.Stderr}
+	case strings.HasPrefix(exporter, "http://") || strings.HasPrefix(exporter, "https://"):
+		otlpExporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(strings.TrimSuffix(exporter, "/")+"/v1/traces"))
+		if err != nil {
+			return nil, err
+		}
+		spanExporter = otlpExporter
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q, expected stdout, stderr or an OTLP/HTTP URL", exporter)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Starts a child of the client's current span and returns a copy of the client
+// whose spans and RPCs are children of the new span
+func (surfClient RPCClient) startSpan(name string, attrs ...attribute.KeyValue) (RPCClient, trace.Span) {
+	ctx := trace.ContextWithSpanContext(context.Background(), surfClient.spanContext)
+	_, span := tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+	surfClient.spanContext = span.SpanContext()
+	return surfClient, span
+}
+
+// Marks span as failed with err and returns err
+func spanError(span trace.Span, err error) error {
+	span.RecordError(err)
+	span.SetStatus(otelcodes.Error, err.Error())
+	return err
+}
+
+// Adapts gRPC metadata to the carrier the trace context propagator writes to
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key string, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func rpcSpanAttributes(fullMethod string) []attribute.KeyValue {
+	service, method := splitFullMethod(fullMethod)
+	return []attribute.KeyValue{
+		attribute.String("rpc.system", "grpc"),
+		attribute.String("rpc.service", service),
+		attribute.String("rpc.method", method),
+	}
+}
+
+func endRPCSpan(span trace.Span, err error) {
+	span.SetAttributes(attribute.Int64("rpc.grpc.status_code", int64(status.Code(err))))
+	if err != nil {
+		spanError(span, err)
+	}
+	span.End()
+}
+
+// tracingUnaryClientInterceptor records a span for an RPC the client makes and
+// sends its trace context along
+func tracingUnaryClientInterceptor(ctx context.Context, fullMethod string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := tracer.Start(ctx, fullMethod, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(rpcSpanAttributes(fullMethod)...))
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+	err := invoker(metadata.NewOutgoingContext(ctx, md), fullMethod, req, reply, cc, opts...)
+	endRPCSpan(span, err)
+	return err
+}
+
+// TracingUnaryServerInterceptor records a span for each RPC a server handles,
+// continuing the trace of the client that made it
+func TracingUnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+	ctx, span := tracer.Start(ctx, info.FullMethod, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(rpcSpanAttributes(info.FullMethod)...))
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		span.SetAttributes(attribute.String("surfstore.request_id", requestID))
+	}
+	resp, err := handler(ctx, req)
+	endRPCSpan(span, err)
+	return resp, err
+}
+
+// A span as the JSON exporters write it
+type spanJSON struct {
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	Name         string                 `json:"name"`
+	Kind         string                 `json:"kind"`
+	Service      string                 `json:"service"`
+	Start        time.Time              `json:"start"`
+	End          time.Time              `json:"end"`
+	DurationMs   float64                `json:"durationMs"`
+	Attributes   map[string]interface{} `json:"attributes,omitempty"`
+	Status       string                 `json:"status,omitempty"`
+	Error        string                 `json:"error,omitempty"`
+}
+
+// Writes each span as one line of JSON
+type jsonSpanExporter struct {
+	w   io.Writer
+	mtx sync.Mutex
+}
+
+func (e *jsonSpanExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+	encoder := json.NewEncoder(e.w)
+	for _, span := range spans {
+		line := spanJSON{
+			TraceID:    span.SpanContext().TraceID().String(),
+			SpanID:     span.SpanContext().SpanID().String(),
+			Name:       span.Name(),
+			Kind:       span.SpanKind().String(),
+			Start:      span.StartTime(),
+			End:        span.EndTime(),
+			DurationMs: float64(span.EndTime().Sub(span.StartTime())) / float64(time.Millisecond),
+			Attributes: map[string]interface{}{},
+		}
+		if span.Parent().IsValid() {
+			line.ParentSpanID = span.Parent().SpanID().String()
+		}
+		for _, kv := range span.Resource().Attributes() {
+			if kv.Key == "service.name" {
+				line.Service = kv.Value.AsString()
+			}
+		}
+		for _, kv := range span.Attributes() {
+			line.Attributes[string(kv.Key)] = kv.Value.AsInterface()
+		}
+		if span.Status().Code == otelcodes.Error {
+			line.Status = "error"
+			line.Error = span.Status().Description
+		}
+		if err := encoder.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *jsonSpanExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
@@ -1,35 +1,136 @@
 package surfstore
 
 import (
+	"errors"
+	"fmt"
 	"io"
-	"io/ioutil"
-	"log"
-	"math"
+	"io/fs"
 	"os"
+	"path"
+	"path/filepath"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/protobuf/proto"
 )
 
-func uploadFile(client RPCClient, metaData *FileMetaData, blockHashes []string) error {
-	filepath := client.BaseDir + "/" + metaData.Filename
-	var version int32
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
-		err = client.UpdateFile(metaData, &version)
-		if err != nil {
-			log.Fatal(err)
+// Commits the metadata of the given files in one batch, expecting each to be
+// at the version in remoteIndex. Files changed on the server in the meantime
+// are left out and marked with version -1 so they are downloaded instead, and
+// files the user may not write or that would exceed a quota are skipped; the
+// rest are committed together. The reasons for the files over quota are
+// returned.
+func commitFiles(client RPCClient, metaDatas []*FileMetaData, remoteIndex map[string]*FileMetaData) (conflicted bool, overQuota []string, err error) {
+	commit := func(fileUpdates []*FileUpdate, result *BatchResult) error {
+		if err := client.CommitBatch(fileUpdates, result); err != nil {
+			return err
+		}
+		if !result.Committed {
+			return nil
+		}
+		committed := make([]*FileMetaData, 0, len(fileUpdates))
+		for _, fileUpdate := range fileUpdates {
+			fileUpdate.FileMetaData.Version = result.Versions[fileUpdate.FileMetaData.Filename]
+			committed = append(committed, fileUpdate.FileMetaData)
+		}
+		return client.journal.recordCommit(committed...)
+	}
+	_, conflicted, overQuota, err = settleBatch(client, commit, metaDatas, remoteIndex)
+	return conflicted, overQuota, err
+}
+
+// Asks the server which of the given files commitFiles would commit, so that
+// the blocks of the others are not uploaded for nothing. The files are left
+// out and marked like commitFiles does.
+func checkFiles(client RPCClient, metaDatas []*FileMetaData, remoteIndex map[string]*FileMetaData) (accepted []*FileMetaData, conflicted bool, overQuota []string, err error) {
+	return settleBatch(client, client.CheckBatch, metaDatas, remoteIndex)
+}
+
+// Calls commit with the given files until it accepts the files that are left,
+// dropping those that conflict, are denied or are over quota in between.
+// Returns the accepted files.
+func settleBatch(client RPCClient, commit func([]*FileUpdate, *BatchResult) error, metaDatas []*FileMetaData, remoteIndex map[string]*FileMetaData) (accepted []*FileMetaData, conflicted bool, overQuota []string, err error) {
+	for len(metaDatas) > 0 {
+		fileUpdates := make([]*FileUpdate, 0, len(metaDatas))
+		for _, metaData := range metaDatas {
+			var expectedVersion int32
+			if remote, ok := remoteIndex[metaData.Filename]; ok {
+				expectedVersion = remote.Version
+			}
+			fileUpdates = append(fileUpdates, &FileUpdate{FileMetaData: metaData, ExpectedVersion: expectedVersion})
+		}
+		var result BatchResult
+		if err := commit(fileUpdates, &result); err != nil {
+			return nil, conflicted, overQuota, err
 		}
-		metaData.Version = version
+		if result.Committed {
+			return metaDatas, conflicted, overQuota, nil
+		}
+
+		denied := make(map[string]bool)
+		for _, filename := range result.Denied {
+			client.logger().Warn("skipping upload", "file", filename, "reason", "permission denied")
+			denied[filename] = true
+		}
+		for _, metaData := range metaDatas {
+			if reason, ok := result.OverQuota[metaData.Filename]; ok {
+				client.logger().Warn("skipping upload", "file", metaData.Filename, "reason", reason)
+				overQuota = append(overQuota, fmt.Sprintf("%s: %s", metaData.Filename, reason))
+				denied[metaData.Filename] = true
+			}
+		}
+		conflicts := make(map[string]bool)
+		for _, filename := range result.Conflicts {
+			client.logger().Info("skipping upload", "file", filename, "reason", "changed on the server")
+			conflicts[filename] = true
+			conflicted = true
+		}
+		remaining := make([]*FileMetaData, 0, len(metaDatas))
+		for _, metaData := range metaDatas {
+			if conflicts[metaData.Filename] {
+				metaData.Version = -1
+			} else if !denied[metaData.Filename] {
+				remaining = append(remaining, metaData)
+			}
+		}
+		metaDatas = remaining
+	}
+	return metaDatas, conflicted, overQuota, nil
+}
+
+// Brings the remote index up to date by fetching only the files changed on
+// the server since it was last refreshed, or the whole map if the server
+// cannot tell
+func refreshRemoteIndex(client RPCClient, remoteIndex *RemoteIndex) error {
+	var changes FileChanges
+	if err := client.GetChangesSince(remoteIndex.Epoch, remoteIndex.Seq, &changes); err != nil {
 		return err
 	}
+	if changes.Full {
+		remoteIndex.FileMetaMap = make(map[string]*FileMetaData)
+	}
+	for filename, fileMetaData := range changes.FileInfoMap {
+		remoteIndex.FileMetaMap[filename] = fileMetaData
+	}
+	remoteIndex.Epoch = changes.Epoch
+	remoteIndex.Seq = changes.Seq
+	return nil
+}
 
+// Uploads the blocks of a local file to their responsible block servers
+func putFileBlocks(client RPCClient, filepath string, blockHashes []string) error {
 	file, err := os.Open(filepath)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
 	var blockStoreMap map[string][]string
 	if err := client.GetBlockStoreMap(blockHashes, &blockStoreMap); err != nil {
-		log.Fatal(err)
+		return err
 	}
 	hashToAddr := make(map[string]string)
 	for addr, hashes := range blockStoreMap {
@@ -37,55 +138,106 @@ func uploadFile(client RPCClient, metaData *FileMetaData, blockHashes []string)
 			hashToAddr[hash] = addr
 		}
 	}
-	fileStat, _ := os.Stat(filepath)
-	numBlocks := int(math.Ceil(float64(fileStat.Size()) / float64(client.BlockSize)))
-	for i := 0; i < numBlocks; i++ {
+	// Blocks an interrupted sync uploaded are skipped if their BlockStore
+	// still has them
+	journaled := make(map[string][]string)
+	for _, hash := range blockHashes {
+		if client.journal.has(hash) {
+			journaled[hashToAddr[hash]] = append(journaled[hashToAddr[hash]], hash)
+		}
+	}
+	stored := make(map[string]bool)
+	for addr, hashes := range journaled {
+		var present []string
+		if err := client.HasBlocks(hashes, addr, &present); err != nil {
+			return err
+		}
+		for _, hash := range present {
+			stored[hash] = true
+		}
+	}
+	for range blockHashes {
 		blockData := make([]byte, client.BlockSize)
-		n, err := file.Read(blockData)
-		if err != nil && err != io.EOF {
-			log.Fatal(err)
+		n, err := io.ReadFull(file, blockData)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
 		}
 		blockData = blockData[:n]
+		hash := GetBlockHashString(blockData)
+		if stored[hash] {
+			continue
+		}
 
 		block := Block{BlockData: blockData, BlockSize: int32(n)}
 
+		client.Bandwidth.waitUpload(n)
 		var success bool
-		if err := client.PutBlock(&block, hashToAddr[GetBlockHashString(blockData)], &success); err != nil {
-			log.Fatal(err)
+		if err := client.PutBlock(&block, hashToAddr[hash], &success); err != nil {
+			return err
+		}
+		if err := client.journal.recordBlock(hash); err != nil {
+			return err
 		}
 	}
-
-	if err := client.UpdateFile(metaData, &version); err != nil {
-		log.Fatal(err)
-		metaData.Version = -1
-	}
-	metaData.Version = version
-
 	return nil
 }
 
 func downloadFile(client RPCClient, local *FileMetaData, remote *FileMetaData) error {
 	filepath := client.BaseDir + "/" + remote.Filename
-	file, err := os.Create(filepath)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer file.Close()
 
-	*local = *remote
+	proto.Reset(local)
+	proto.Merge(local, remote)
 
-	//File deleted in server
-	if len(remote.BlockHashList) == 1 && remote.BlockHashList[0] == "0" {
+	// Replace a local symlink instead of writing through it
+	if info, err := os.Lstat(filepath); err == nil && (info.Mode()&os.ModeSymlink != 0 || remote.SymlinkTarget != "") {
 		if err := os.Remove(filepath); err != nil {
-			log.Fatal(err)
+			return err
+		}
+	}
+
+	//File deleted in server
+	if isTombstone(remote) {
+		if err := os.Remove(filepath); err != nil && !os.IsNotExist(err) {
 			return err
 		}
 		return nil
 	}
 
+	if err := os.MkdirAll(path.Dir(filepath), 0755); err != nil {
+		return err
+	}
+	if remote.SymlinkTarget != "" {
+		return os.Symlink(remote.SymlinkTarget, filepath)
+	}
+
+	// The blocks are written beside the file and moved over it once they are
+	// all there, so an interrupted download leaves the old contents in place
+	tmpPath := partFilePath(client, filepath)
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	err = fetchBlocks(client, remote.BlockHashList, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = restoreFileAttributes(tmpPath, remote)
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filepath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+	}
+	return err
+}
+
+// Writes the blocks with the given hashes to w in order
+func fetchBlocks(client RPCClient, blockHashes []string, w io.Writer) error {
 	var blockStoreMap map[string][]string
-	if err := client.GetBlockStoreMap(remote.BlockHashList, &blockStoreMap); err != nil {
-		log.Fatal(err)
+	if err := client.GetBlockStoreMap(blockHashes, &blockStoreMap); err != nil {
+		return err
 	}
 	hashToAddr := make(map[string]string)
 	for addr, hashes := range blockStoreMap {
@@ -93,99 +245,454 @@ func downloadFile(client RPCClient, local *FileMetaData, remote *FileMetaData) e
 			hashToAddr[hash] = addr
 		}
 	}
-
-	data := ""
-	for _, hash := range remote.BlockHashList {
+	for _, hash := range blockHashes {
 		var block Block
 		if err := client.GetBlock(hash, hashToAddr[hash], &block); err != nil {
-			log.Fatal(err)
+			return err
+		}
+		client.Bandwidth.waitDownload(len(block.BlockData))
+		if _, err := w.Write(block.BlockData); err != nil {
+			return err
 		}
-
-		data += string(block.BlockData)
 	}
-	file.WriteString(data)
+	return nil
+}
 
+// Restores the permissions and modification time recorded for a file
+func restoreFileAttributes(filepath string, metaData *FileMetaData) error {
+	if metaData.Mode != 0 {
+		if err := os.Chmod(filepath, fileModeOf(metaData.Mode)); err != nil {
+			return err
+		}
+	}
+	if metaData.Mtime != 0 {
+		mtime := time.Unix(0, metaData.Mtime)
+		if err := os.Chtimes(filepath, mtime, mtime); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-// Implement the logic for a client syncing with the server here.
-func ClientSync(client RPCClient) {
-	localIndex, err := LoadMetaFromMetaFile(client.BaseDir)
+// Lists the files under baseDir by their slash-separated path relative to it,
+// leaving out index.db. Directories are walked, not listed, and symlinks are
+// not followed.
+func listLocalFiles(baseDir string, scope *syncScope) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.WalkDir(baseDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == baseDir {
+			return err
+		}
+		relPath, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		filename := filepath.ToSlash(relPath)
+		if entry.IsDir() {
+			if !scope.traverses(filename) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !scope.includes(filename) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files[filename] = info
+		return nil
+	})
+	return files, err
+}
+
+func sortedKeys(files map[string]os.FileInfo) []string {
+	filenames := make([]string, 0, len(files))
+	for filename := range files {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+	return filenames
+}
+
+// Builds the metadata of a local file: its blocks, size, modification time,
+// mode and, for a symlink, its target. The version is left for the caller.
+// Unless a full rescan is requested, the blocks of a file that matches its
+// scan cache entry are taken from its last synced metadata without rehashing.
+func scanFile(client RPCClient, filename string, info os.FileInfo, synced *FileMetaData, cached *ScanCacheEntry) (*FileMetaData, error) {
+	filepath := client.BaseDir + "/" + filename
+	metaData := &FileMetaData{
+		Filename: filename,
+		Size:     info.Size(),
+		Mtime:    info.ModTime().UnixNano(),
+		Mode:     posixModeOf(info.Mode()),
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(filepath)
+		if err != nil {
+			return nil, err
+		}
+		metaData.SymlinkTarget = target
+		return metaData, nil
+	}
+
+	if !client.FullRescan && synced != nil && !isTombstone(synced) && synced.SymlinkTarget == "" &&
+		reflect.DeepEqual(cached, scanCacheEntryOf(info)) && len(synced.BlockHashList) == numBlocksOf(info.Size(), client.BlockSize) {
+		metaData.BlockHashList = synced.BlockHashList
+		metaData.BlockSizeList = blockSizesOf(info.Size(), client.BlockSize)
+		return metaData, nil
+	}
+
+	file, err := os.Open(filepath)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	defer file.Close()
+	metaData.BlockHashList, metaData.BlockSizeList, err = hashBlocks(file, client.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	return metaData, nil
+}
+
+// Splits r into blocks of blockSize bytes and returns their hashes and sizes
+func hashBlocks(r io.Reader, blockSize int) (blockHashes []string, blockSizes []int32, err error) {
+	for {
+		blockData := make([]byte, blockSize)
+		n, err := io.ReadFull(r, blockData)
+		if n > 0 {
+			blockHashes = append(blockHashes, GetBlockHashString(blockData[:n]))
+			blockSizes = append(blockSizes, int32(n))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blockHashes, blockSizes, nil
+		} else if err != nil {
+			return nil, nil, err
+		}
 	}
+}
+
+// Returns the number of blocks a file of the given size is split into
+func numBlocksOf(size int64, blockSize int) int {
+	return int((size + int64(blockSize) - 1) / int64(blockSize))
+}
+
+// Returns the sizes of the blocks a file of the given size is split into
+func blockSizesOf(size int64, blockSize int) []int32 {
+	var blockSizes []int32
+	for ; size > 0; size -= int64(blockSize) {
+		if size < int64(blockSize) {
+			blockSizes = append(blockSizes, int32(size))
+		} else {
+			blockSizes = append(blockSizes, int32(blockSize))
+		}
+	}
+	return blockSizes
+}
+
+// Reports whether a scanned file differs from its last synced metadata. A
+// mode of 0 comes from an index written before modes were recorded.
+func fileChanged(synced *FileMetaData, scanned *FileMetaData) bool {
+	if len(synced.BlockHashList) != 0 || len(scanned.BlockHashList) != 0 {
+		if !reflect.DeepEqual(synced.BlockHashList, scanned.BlockHashList) {
+			return true
+		}
+	}
+	return synced.SymlinkTarget != scanned.SymlinkTarget || (synced.Mode != 0 && synced.Mode != scanned.Mode)
+}
 
-	files, err := ioutil.ReadDir(client.BaseDir)
+// The state a sync starts from: the local index updated with a scan of the
+// base directory, and the server's file map
+type syncState struct {
+	localIndex map[string]*FileMetaData
+	scanCache  map[string]*ScanCacheEntry
+	scope      *syncScope
+	hashMap    map[string][]string
+	changed    map[string]bool
+	created    []string
+	deleted    map[string]*FileMetaData
+	remote     *RemoteIndex
+}
+
+// Scans the base directory against index.db and fetches the server's changes.
+// Nothing is written locally or to the server.
+func prepareSync(client RPCClient) (*syncState, error) {
+	state := &syncState{
+		hashMap: make(map[string][]string),
+		changed: make(map[string]bool),
+		created: []string{},
+		deleted: make(map[string]*FileMetaData),
+	}
+	files, err := scanBaseDir(client, state)
 	if err != nil {
-		log.Fatal(err)
-	}
-	hashMap := make(map[string][]string)
-	for _, file := range files {
-		if file.Name() != "index.db" {
-			blocks := int(math.Ceil(float64(file.Size()) / float64(client.BlockSize)))
-			f, err := os.Open(client.BaseDir + "/" + file.Name())
-			if err != nil {
-				log.Fatal(err)
-			}
-			for i := 0; i < blocks; i++ {
-				blockData := make([]byte, client.BlockSize)
-				n, err := f.Read(blockData)
-				if err != nil {
-					log.Fatal(err)
-				}
-				blockData = blockData[:n]
-				hash := GetBlockHashString(blockData)
-				hashMap[file.Name()] = append(hashMap[file.Name()], hash)
-			}
+		return nil, err
+	}
+	if err := hashFiles(client, state, files); err != nil {
+		return nil, err
+	}
+	if err := planSync(client, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
 
-			if metaData, ok := localIndex[file.Name()]; ok {
-				if !reflect.DeepEqual(hashMap[file.Name()], metaData.BlockHashList) {
-					localIndex[file.Name()].BlockHashList = hashMap[file.Name()]
-					localIndex[file.Name()].Version++
-				}
-			} else {
-				localIndex[file.Name()] = &FileMetaData{Filename: file.Name(), Version: 1, BlockHashList: hashMap[file.Name()]}
+// Loads index.db and the scan cache into state and lists the files in the
+// base directory
+func scanBaseDir(client RPCClient, state *syncState) (map[string]os.FileInfo, error) {
+	scanClient, span := client.startSpan("scan")
+	defer span.End()
+	var err error
+	if state.localIndex, err = LoadMetaFromMetaFile(client.BaseDir); err != nil {
+		return nil, spanError(span, err)
+	}
+	if state.scanCache, err = LoadScanCache(client.BaseDir); err != nil {
+		return nil, spanError(span, err)
+	}
+	if state.scope, err = newSyncScope(scanClient); err != nil {
+		return nil, spanError(span, err)
+	}
+	files, err := listLocalFiles(client.BaseDir, state.scope)
+	if err != nil {
+		return nil, spanError(span, err)
+	}
+	span.SetAttributes(attribute.Int("surfstore.files", len(files)))
+	return files, nil
+}
+
+// Updates the local index with the files in the base directory, recording
+// which files were changed, created and deleted since the last sync
+func hashFiles(client RPCClient, state *syncState, files map[string]os.FileInfo) error {
+	hashClient, span := client.startSpan("hash")
+	defer span.End()
+	localIndex, scanCache, scope := state.localIndex, state.scanCache, state.scope
+	for _, filename := range sortedKeys(files) {
+		file := files[filename]
+		scanned, err := scanFile(hashClient, filename, file, localIndex[filename], scanCache[filename])
+		if err != nil {
+			return spanError(span, err)
+		}
+		state.hashMap[filename] = scanned.BlockHashList
+		scanCache[filename] = scanCacheEntryOf(file)
+
+		if metaData, ok := localIndex[filename]; ok {
+			scanned.Version = metaData.Version
+			if fileChanged(metaData, scanned) {
+				scanned.Version++
+				state.changed[filename] = true
 			}
+			if isTombstone(metaData) {
+				state.created = append(state.created, filename)
+			}
+		} else {
+			scanned.Version = 1
+			state.changed[filename] = true
+			state.created = append(state.created, filename)
 		}
+		localIndex[filename] = scanned
 	}
 
 	for filename, metaData := range localIndex {
-		if _, ok := hashMap[filename]; !ok {
-			if len(metaData.BlockHashList) != 1 || metaData.BlockHashList[0] != "0" {
-				metaData.Version++
-				metaData.BlockHashList = []string{"0"}
+		// Files outside the scope are left alone rather than deleted
+		if !scope.includes(filename) {
+			continue
+		}
+		if _, ok := state.hashMap[filename]; !ok {
+			delete(scanCache, filename)
+			if !isTombstone(metaData) {
+				state.deleted[filename] = proto.Clone(metaData).(*FileMetaData)
+				state.changed[filename] = true
+				version := metaData.Version + 1
+				proto.Reset(metaData)
+				metaData.Filename = filename
+				metaData.Version = version
+				metaData.BlockHashList = []string{TOMBSTONE_HASHVALUE}
 			}
 		}
 	}
 
-	remoteIndex := make(map[string]*FileMetaData)
-	if err := client.GetFileInfoMap(&remoteIndex); err != nil {
-		log.Fatal(err)
+	span.SetAttributes(attribute.Int("surfstore.changed", len(state.changed)))
+	return nil
+}
+
+// Fetches the server's changes since the last sync into state
+func planSync(client RPCClient, state *syncState) error {
+	planClient, span := client.startSpan("plan")
+	defer span.End()
+	var err error
+	if state.remote, err = LoadRemoteIndex(client.BaseDir); err != nil {
+		return spanError(span, err)
+	}
+	if err := refreshRemoteIndex(planClient, state.remote); err != nil {
+		return spanError(span, err)
+	}
+	return nil
+}
+
+// Reports whether a local file is newer than the server's copy
+func needsUpload(local *FileMetaData, remoteIndex map[string]*FileMetaData) bool {
+	remote, ok := remoteIndex[local.Filename]
+	return !ok || local.Version > remote.Version
+}
+
+// Reports whether the server's copy of a file should replace the local one,
+// which is nil if there is none
+func needsDownload(local *FileMetaData, remote *FileMetaData) bool {
+	if local == nil || local.Version < remote.Version {
+		return true
+	}
+	return local.Version == remote.Version &&
+		(!reflect.DeepEqual(local.BlockHashList, remote.BlockHashList) || local.SymlinkTarget != remote.SymlinkTarget)
+}
+
+// Implement the logic for a client syncing with the server here.
+// Files that could not be uploaded because a quota was exceeded are
+// reported in the returned error once the rest of the sync is done, as
+// are bad ignore patterns before it starts.
+func ClientSync(client RPCClient) error {
+	if client.RequestID == "" {
+		client.RequestID = NewRequestID()
+	}
+	logger := client.logger()
+	logger.Info("sync started", "base_dir", client.BaseDir, "user", client.User)
+	client, span := client.startSpan("ClientSync",
+		attribute.String("surfstore.base_dir", client.BaseDir), attribute.String("surfstore.request_id", client.RequestID))
+	defer span.End()
+	if err := negotiateBlockSize(&client); err != nil {
+		return spanError(span, err)
+	}
+	state, err := prepareSync(client)
+	if err != nil {
+		return spanError(span, err)
+	}
+	if client.journal, err = openSyncJournal(client); err != nil {
+		return spanError(span, err)
+	}
+	defer client.journal.close()
+
+	uploads, conflicted, quotaErrors, err := uploadChanges(client, state)
+	if err != nil {
+		return spanError(span, err)
+	}
+	downloads, err := downloadChanges(client, state)
+	if err != nil {
+		return spanError(span, err)
 	}
+	if err := writeIndexes(client, state); err != nil {
+		return spanError(span, err)
+	}
+	logger.Info("sync finished", "uploads", uploads, "downloads", downloads, "conflicted", conflicted)
+	if len(quotaErrors) > 0 {
+		return errors.New(strings.Join(quotaErrors, "\n"))
+	}
+	return nil
+}
+
+// Uploads and commits the files changed locally, leaving out those the server
+// refuses. Returns how many files were committed, whether any conflicted and
+// why the files over a quota were left out.
+func uploadChanges(client RPCClient, state *syncState) (int, bool, []string, error) {
+	uploadClient, span := client.startSpan("upload")
+	defer span.End()
+	localIndex, scope, remote := state.localIndex, state.scope, state.remote
+	remoteIndex := remote.FileMetaMap
+	logger := client.logger()
+	renamed := syncLocalRenames(uploadClient, localIndex, remoteIndex, state.created, state.deleted)
 
+	updates := []*FileMetaData{}
 	for fileName, local := range localIndex {
-		if remote, ok := remoteIndex[fileName]; ok {
-			if local.Version > remote.Version {
-				uploadFile(client, local, hashMap[fileName])
+		if scope.includes(fileName) && needsUpload(local, remoteIndex) {
+			updates = append(updates, local)
+		}
+	}
+	// Leave out the files the commit would refuse before uploading any blocks
+	updates, conflicted, quotaErrors, err := checkFiles(uploadClient, updates, remoteIndex)
+	if err != nil {
+		return 0, false, nil, spanError(span, err)
+	}
+	for _, local := range updates {
+		// Symlinks carry their target and tombstones nothing instead of blocks,
+		// and the blocks of renamed files are stored already
+		if !isTombstone(local) && local.SymlinkTarget == "" && !renamed[local.Filename] {
+			if err := putFileBlocks(uploadClient, ConcatPath(client.BaseDir, local.Filename), state.hashMap[local.Filename]); err != nil {
+				return 0, false, nil, spanError(span, err)
 			}
-		} else {
-			uploadFile(client, local, hashMap[fileName])
 		}
+		logger.Debug("uploading", "file", local.Filename, "version", local.Version)
 	}
+	committedConflicted, commitQuotaErrors, err := commitFiles(uploadClient, updates, remoteIndex)
+	if err != nil {
+		return 0, false, nil, spanError(span, err)
+	}
+	conflicted = conflicted || committedConflicted
+	quotaErrors = append(quotaErrors, commitQuotaErrors...)
+	if conflicted {
+		if err := refreshRemoteIndex(uploadClient, remote); err != nil {
+			return 0, false, nil, spanError(span, err)
+		}
+	}
+	span.SetAttributes(attribute.Int("surfstore.files", len(updates)), attribute.Bool("surfstore.conflicted", conflicted))
+	return len(updates), conflicted, quotaErrors, nil
+}
 
+// Applies the server's changes to the base directory and returns how many
+// files were downloaded
+func downloadChanges(client RPCClient, state *syncState) (int, error) {
+	downloadClient, span := client.startSpan("download")
+	defer span.End()
+	localIndex, scanCache, scope := state.localIndex, state.scanCache, state.scope
+	remoteIndex := state.remote.FileMetaMap
+	logger := client.logger()
+	applyRemoteRenames(downloadClient, localIndex, remoteIndex, scanCache, scope)
+	downloads := 0
 	for filename, remote := range remoteIndex {
-		if local, ok := localIndex[filename]; ok {
-			if local.Version < remote.Version {
-				downloadFile(client, local, remote)
-			} else if local.Version == remote.Version && !reflect.DeepEqual(local.BlockHashList, remote.BlockHashList) {
-				downloadFile(client, local, remote)
-			}
-		} else {
+		if !validFilename(filename) || remote.Filename != filename {
+			logger.Warn("skipping download", "file", filename, "reason", "unsafe file name")
+			continue
+		}
+		if !scope.includes(filename) || !needsDownload(localIndex[filename], remote) {
+			continue
+		}
+		logger.Debug("downloading", "file", filename, "version", remote.Version)
+		downloads++
+		if _, ok := localIndex[filename]; !ok {
 			localIndex[filename] = &FileMetaData{}
-			localMetaData := localIndex[filename]
-			downloadFile(client, localMetaData, remote)
+		}
+		if err := downloadFile(downloadClient, localIndex[filename], remote); err != nil {
+			return 0, spanError(span, err)
+		}
+		if info, err := os.Lstat(client.BaseDir + "/" + filename); err == nil {
+			scanCache[filename] = scanCacheEntryOf(info)
+		} else {
+			delete(scanCache, filename)
+		}
+		if err := client.journal.recordDownload(localIndex[filename], scanCache[filename]); err != nil {
+			return 0, spanError(span, err)
 		}
 	}
 
-	WriteMetaFile(localIndex, client.BaseDir)
+	span.SetAttributes(attribute.Int("surfstore.files", downloads))
+	return downloads, nil
+}
+
+// Writes index.db and the other state kept beside it and marks the sync done
+func writeIndexes(client RPCClient, state *syncState) error {
+	_, span := client.startSpan("index write")
+	defer span.End()
+	if err := WriteMetaFile(state.localIndex, client.BaseDir); err != nil {
+		return spanError(span, err)
+	}
+	if err := WriteRemoteIndex(state.remote, client.BaseDir); err != nil {
+		return spanError(span, err)
+	}
+	if err := WriteScanCache(state.scanCache, client.BaseDir); err != nil {
+		return spanError(span, err)
+	}
+	if err := recordBlockSize(client); err != nil {
+		return spanError(span, err)
+	}
+	if err := client.journal.finish(); err != nil {
+		return spanError(span, err)
+	}
+	return nil
 }